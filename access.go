@@ -0,0 +1,107 @@
+package main
+
+/* Access control for server ports.
+ * Each port can be made read only, and limited to some function codes and register
+ * ranges, in addition to the unit IDs it answers. A denied request is answered with an
+ * exception, Illegal Function for a function that is not allowed and Illegal Data Address
+ * for registers outside the allowed ranges, as a real meter would. The first denial of
+ * each kind is logged and every denial is counted.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/tbrandon/mbserver"
+)
+
+type accessRange struct {
+	Start, Finish int
+}
+
+type accessData struct {
+	ReadOnly  bool          `yaml:"read_only,omitempty"`
+	Functions []byte        `yaml:",flow,omitempty"`
+	Ranges    []accessRange `yaml:",omitempty"`
+}
+
+var (
+	deniedLogged   = make(map[string]bool)
+	deniedLoggedMu sync.Mutex
+)
+
+// writeFunction checks whether the function code changes coils or registers.
+func writeFunction(fn byte) bool {
+	switch fn {
+	case 5, 6, 15, 16, 22, 23:
+		return true
+	}
+	return false
+}
+
+// requestedRegisters returns the table (3 for input, 4 for holding registers, as in the
+// configuration) and registers accessed by a request, if it accesses registers.
+func requestedRegisters(frame *mbserver.RTUFrame) (typ, start, count int, ok bool) {
+	if len(frame.Data) < 4 {
+		return 0, 0, 0, false
+	}
+	start = int(binary.BigEndian.Uint16(frame.Data[0:2]))
+	count = int(binary.BigEndian.Uint16(frame.Data[2:4]))
+	switch frame.Function {
+	case 3, 16, 23:
+		return 4, start, count, true
+	case 4:
+		return 3, start, count, true
+	case 6, 22:
+		return 4, start, 1, true
+	}
+	return 0, 0, 0, false
+}
+
+// check returns the exception for a request that is not allowed, and the reason.
+func (ad accessData) check(frame *mbserver.RTUFrame) (modbusError, string) {
+	if ad.ReadOnly && writeFunction(frame.Function) {
+		return illegalFunction, "read only"
+	}
+	if len(ad.Functions) > 0 {
+		allowed := false
+		for _, fn := range ad.Functions {
+			allowed = allowed || fn == frame.Function
+		}
+		if !allowed {
+			return illegalFunction, "function not allowed"
+		}
+	}
+	if len(ad.Ranges) > 0 {
+		typ, start, count, ok := requestedRegisters(frame)
+		if !ok {
+			return modbusSuccess, ""
+		}
+		var ranges []polledRange
+		for _, rng := range ad.Ranges {
+			sType, sReg, sErr := parseRegister(rng.Start)
+			_, fReg, fErr := parseRegister(rng.Finish)
+			if sErr == nil && fErr == nil {
+				ranges = append(ranges, polledRange{opType: sType, start: int(sReg), end: int(fReg)})
+			}
+		}
+		if !rangeCovers(ranges, typ, start, count) {
+			return illegalAddress, "registers not allowed"
+		}
+	}
+	return modbusSuccess, ""
+}
+
+// logDenied logs the first request denied on the port for each unit, function and reason.
+func logDenied(port string, frame *mbserver.RTUFrame, reason string) {
+	serverDenied.inc(port, fmt.Sprintf("%d", frame.Function), reason)
+	msg := fmt.Sprintf("Server: %s denied unit %d fc %d, %s", port, frame.Address, frame.Function, reason)
+	deniedLoggedMu.Lock()
+	defer deniedLoggedMu.Unlock()
+	if !deniedLogged[msg] {
+		deniedLogged[msg] = true
+		log.Print(msg)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tbrandon/mbserver"
+)
+
+func TestAccessCheck(t *testing.T) {
+	ad := accessData{ReadOnly: true, Functions: []byte{3, 4, 6}, Ranges: []accessRange{
+		{Start: 30001, Finish: 30081}, {Start: 40001, Finish: 40011},
+	}}
+	tests := []struct {
+		function byte
+		data     []byte
+		want     modbusError
+	}{
+		{4, []byte{0, 0, 0, 80}, modbusSuccess},
+		{4, []byte{0, 70, 0, 12}, illegalAddress},
+		{3, []byte{0, 10, 0, 1}, illegalAddress},
+		{3, []byte{0, 8, 0, 2}, modbusSuccess},
+		{6, []byte{0, 1, 0, 5}, illegalFunction},
+		{1, []byte{0, 0, 0, 1}, illegalFunction},
+	}
+	for _, tc := range tests {
+		got, reason := ad.check(&mbserver.RTUFrame{Address: 1, Function: tc.function, Data: tc.data})
+		if got != tc.want {
+			t.Errorf("fc %d % x: expected %v, got %v (%s)", tc.function, tc.data, tc.want, got, reason)
+		}
+	}
+	if mErr, _ := (accessData{}).check(&mbserver.RTUFrame{Function: 16, Data: []byte{0, 0, 0, 1}}); mErr != modbusSuccess {
+		t.Errorf("expected no policy to allow writes, got %v", mErr)
+	}
+}
+
+func TestReadOnlyServerPort(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(1)
+	sp := &serverPort{cfg: serverData{Access: accessData{ReadOnly: true}}, name: "readonly"}
+	out := sp.handleRequest(&mbserver.RTUFrame{Address: 1, Function: 6, Data: []byte{0, 0, 0, 9}})
+	if want := []byte{1, 0x86, byte(illegalFunction)}; string(out[:len(out)-2]) != string(want) {
+		t.Errorf("expected write to be refused with % x, got % x", want, out)
+	}
+	regA, _ := getRegisterAccess(1, 3)
+	if data, _ := regA.Read(0, 1); data[1] != 0 || data[2] != 0 {
+		t.Errorf("register was written: % x", data)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+/* Synthetic meters.
+ * An aggregate presents a virtual device with the layout of a meter, each value being
+ * worked out from the same value on several polled meters. Most values are added, or
+ * subtracted for sources marked subtract, while voltages and frequency are averaged and
+ * power factors are calculated from the combined powers. The aggregate becomes a set of
+ * virtual registers, so is served in the same way.
+ *
+ * Each source's phases are added to the same phase of the aggregate, unless the source
+ * gives the phase each of its phases is connected to, e.g. [2] for a single phase meter
+ * on the second phase, or [1, 1, 1] to combine every phase into a single phase meter.
+ *
+ * A source can be a different model, given by its own layout, so a single source acts
+ * as a translation of one meter's registers into those of another.
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type aggregateSource struct {
+	Device   byte
+	Layout   string
+	Subtract bool
+	Phases   []int
+}
+
+type aggregateData struct {
+	Device         byte
+	Layout         string
+	Sources        []aggregateSource
+	Identification identificationData `yaml:",omitempty"`
+}
+
+// sourcePhases returns the source's phases connected to the aggregate's phase.
+func (src aggregateSource) sourcePhases(phase int) []int {
+	if phase == 0 || len(src.Phases) == 0 {
+		return []int{phase}
+	}
+	var out []int
+	for n, p := range src.Phases {
+		if p == phase {
+			out = append(out, n+1)
+		}
+	}
+	return out
+}
+
+// sumExpression adds the field from every source, returning the number of terms.
+func (agg aggregateData) sumExpression(layouts []*meterLayout, name string, phase int, signed bool) (string, int) {
+	var expr strings.Builder
+	terms := 0
+	for si, src := range agg.Sources {
+		for _, srcPhase := range src.sourcePhases(phase) {
+			fld, ok := layouts[si].field(name, srcPhase)
+			if !ok {
+				continue
+			}
+			switch {
+			case signed && src.Subtract:
+				expr.WriteString(" - ")
+			case terms > 0:
+				expr.WriteString(" + ")
+			}
+			expr.WriteString(fld.scaled(src.Device))
+			terms++
+		}
+	}
+	return strings.TrimPrefix(expr.String(), " "), terms
+}
+
+// fieldExpression returns the expression for a field of the aggregate.
+func (agg aggregateData) fieldExpression(layouts []*meterLayout, fld meterField) string {
+	expr := "0"
+	switch fld.Aggregate {
+	case "", "sum":
+		if sum, terms := agg.sumExpression(layouts, fld.Name, fld.Phase, true); terms > 0 {
+			expr = sum
+		}
+	case "average":
+		if sum, terms := agg.sumExpression(layouts, fld.Name, fld.Phase, false); terms > 0 {
+			expr = fmt.Sprintf("(%s) / %d", sum, terms)
+		}
+	case "ratio":
+		num, nTerms := agg.sumExpression(layouts, fld.Numerator, fld.Phase, true)
+		den, dTerms := agg.sumExpression(layouts, fld.Denominator, fld.Phase, true)
+		if nTerms > 0 && dTerms > 0 {
+			expr = fmt.Sprintf("(%s) / (%s)", num, den)
+		}
+	}
+	if fld.Scale != 0 && fld.Scale != 1 && expr != "0" {
+		expr = fmt.Sprintf("(%s) / %s", expr, strconv.FormatFloat(fld.Scale, 'f', -1, 64))
+	}
+	return expr
+}
+
+// overrides returns the virtual registers for the aggregate, using the layouts loaded
+// from the configuration as well as those bundled.
+func (agg aggregateData) overrides(loaded map[string]*meterLayout) ([]registerOverride, error) {
+	ml, err := findMeterLayout(loaded, agg.Layout)
+	if err != nil {
+		return nil, err
+	}
+	layouts := make([]*meterLayout, len(agg.Sources))
+	for si, src := range agg.Sources {
+		layouts[si] = ml
+		if src.Layout != "" {
+			if layouts[si], err = findMeterLayout(loaded, src.Layout); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var out []registerOverride
+	for _, fld := range ml.Fields {
+		out = append(out, registerOverride{Device: agg.Device, Register: fld.Register, Type: fld.Type,
+			Expression: agg.fieldExpression(layouts, fld)})
+	}
+	return out, nil
+}
+
+// expandAggregates returns the virtual registers for every valid aggregate.
+func expandAggregates(cfg configData) []registerOverride {
+	var out []registerOverride
+	for _, agg := range cfg.Aggregates {
+		ovs, err := agg.overrides(cfg.layouts)
+		if err == nil {
+			out = append(out, ovs...)
+		}
+	}
+	return out
+}
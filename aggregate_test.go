@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAggregateExpressions(t *testing.T) {
+	agg := aggregateData{Device: 20, Layout: "sdm630", Sources: []aggregateSource{
+		{Device: 2},
+		{Device: 3, Subtract: true},
+		{Device: 4, Phases: []int{2}},
+	}}
+	ml, err := findMeterLayout(nil, agg.Layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layouts := []*meterLayout{ml, ml, ml}
+	for _, tc := range []struct {
+		name  string
+		phase int
+		want  string
+	}{
+		{"power", 1, "{2:30013:float32} - {3:30013:float32}"},
+		{"power", 2, "{2:30015:float32} - {3:30015:float32} + {4:30013:float32}"},
+		{"voltage", 3, "({2:30005:float32} + {3:30005:float32}) / 2"},
+		{"power_factor", 1, "({2:30013:float32} - {3:30013:float32}) / ({2:30019:float32} - {3:30019:float32})"},
+		{"total_power", 0, "{2:30053:float32} - {3:30053:float32} + {4:30053:float32}"},
+	} {
+		fld, ok := ml.field(tc.name, tc.phase)
+		if !ok {
+			t.Fatalf("no field %s phase %d", tc.name, tc.phase)
+		}
+		if got := agg.fieldExpression(layouts, fld); got != tc.want {
+			t.Errorf("%s phase %d: expected %q, got %q", tc.name, tc.phase, tc.want, got)
+		}
+	}
+
+	if _, err := (aggregateData{Layout: "nosuchmeter"}).overrides(nil); err == nil {
+		t.Error("expected an error for an unknown layout")
+	}
+}
+
+func TestAggregateValues(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	set := func(dev byte, reg int, v float32) {
+		_, idx, _ := parseRegister(reg)
+		regA, _ := getRegisterAccess(dev, 4)
+		regA.Write(int(idx), 2, binary.BigEndian.AppendUint32(nil, math.Float32bits(v)))
+	}
+	addStandardDevice(2)
+	addStandardDevice(3)
+	set(2, 30001, 240)
+	set(3, 30001, 230)
+	set(2, 30013, 1000)
+	set(3, 30013, 500)
+	set(2, 30019, 1250)
+	set(3, 30019, 625)
+
+	cfg := configData{Aggregates: []aggregateData{{Device: 20, Layout: "sdm630",
+		Sources: []aggregateSource{{Device: 2}, {Device: 3}}}}}
+	cfg.Virtual = expandAggregates(cfg)
+	compileOverrides(cfg.Virtual)
+	addVirtualDevices(cfg)
+
+	regA, mErr := getRegisterAccess(20, 4)
+	if mErr != modbusSuccess {
+		t.Fatal(mErr)
+	}
+	data, _ := regA.Read(0, 36)
+	applyOverrides(cfg.Virtual, 20, 4, 0, data)
+	value := func(idx int) float32 {
+		return math.Float32frombits(binary.BigEndian.Uint32(data[1+idx*2:]))
+	}
+	if v := value(0); v != 235 {
+		t.Errorf("expected average voltage 235, got %v", v)
+	}
+	if v := value(12); v != 1500 {
+		t.Errorf("expected power 1500, got %v", v)
+	}
+	if v := value(30); v != 0.8 {
+		t.Errorf("expected power factor 0.8, got %v", v)
+	}
+	if v := value(14); v != 0 {
+		t.Errorf("expected no power on phase 2, got %v", v)
+	}
+}
+
+func TestTranslateMeter(t *testing.T) {
+	// An SDM630 presented as an SDM120, with every phase combined.
+	agg := aggregateData{Device: 1, Layout: "sdm120", Sources: []aggregateSource{
+		{Device: 2, Layout: "sdm630", Phases: []int{1, 1, 1}}}}
+	ovs, err := agg.overrides(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{
+		30001: "({2:30001:float32} + {2:30003:float32} + {2:30005:float32}) / 3",
+		30073: "{2:30073:float32}",
+	}
+	for _, ov := range ovs {
+		if w, ck := want[ov.Register]; ck && ov.Expression != w {
+			t.Errorf("register %d: expected %q, got %q", ov.Register, w, ov.Expression)
+		}
+	}
+
+	// An SDM120 presented as a scaled EM340, the totals coming from phase 1.
+	agg = aggregateData{Device: 1, Layout: "em340", Sources: []aggregateSource{{Device: 2, Layout: "sdm120"}}}
+	if ovs, err = agg.overrides(nil); err != nil {
+		t.Fatal(err)
+	}
+	want = map[int]string{
+		40019: "({2:30013:float32}) / 0.1",
+		40041: "({2:30013:float32}) / 0.1",
+		40021: "0",
+	}
+	for _, ov := range ovs {
+		if w, ck := want[ov.Register]; ck && ov.Expression != w {
+			t.Errorf("register %d: expected %q, got %q", ov.Register, w, ov.Expression)
+		}
+	}
+
+	// And back again.
+	agg = aggregateData{Device: 1, Layout: "sdm630", Sources: []aggregateSource{{Device: 2, Layout: "em340"}}}
+	if ovs, err = agg.overrides(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ov := range ovs {
+		if ov.Register == 30007 && ov.Expression != "{2:40013:int32_swapped} * 0.001" {
+			t.Errorf("unexpected current %q", ov.Expression)
+		}
+	}
+}
+
+func TestLoadMeterLayouts(t *testing.T) {
+	layouts, err := loadMeterLayouts([]string{"testdata/meter_layout.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml, err := findMeterLayout(layouts, "TestMeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fld, ok := ml.field("total_power", 0); !ok || fld.Register != 40003 {
+		t.Errorf("expected single phase total power from register 40003, got %v", fld)
+	}
+	for _, name := range []string{"sdm120", "sdm630", "em340", "ddsu666"} {
+		if _, err := findMeterLayout(layouts, name); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTranslateDDSU666(t *testing.T) {
+	// The meter's registers lie beyond those held, so are polled with offsets.
+	regs := make([]uint16, 0x4010)
+	setFloat := func(reg int, v float32) {
+		bits := math.Float32bits(v)
+		regs[reg], regs[reg+1] = uint16(bits>>16), uint16(bits)
+	}
+	setFloat(0x2000, 241.5)
+	setFloat(0x2004, 1.5)
+	setFloat(0x4000, 1234)
+
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(2)
+	port := newRTUPort(rtuData{Baudrate: 9600}, 100*time.Millisecond)
+	port.port = &chunkedPort{respond: holdingResponder(regs), chunk: 16}
+	dev := newDevice(port, "test", 2)
+	bus := deviceBus{name: "test", port: port, devices: []device{dev}}
+	for _, rng := range []regRange{{Start: 48193, Finish: 48209, Offset: 8192}, {Start: 416385, Finish: 416397, Offset: 16352}} {
+		act, err := deviceActionFromConfig(rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bus.poll(dev, act)
+		if act.errorCount() != 0 {
+			t.Fatalf("%v failed", act)
+		}
+	}
+
+	cfg := configData{Aggregates: []aggregateData{{Device: 1, Layout: "sdm120",
+		Sources: []aggregateSource{{Device: 2, Layout: "ddsu666"}}}}}
+	cfg.Virtual = expandAggregates(cfg)
+	compileOverrides(cfg.Virtual)
+	addVirtualDevices(cfg)
+
+	regA, mErr := getRegisterAccess(1, 4)
+	if mErr != modbusSuccess {
+		t.Fatal(mErr)
+	}
+	data, _ := regA.Read(0, 74)
+	applyOverrides(cfg.Virtual, 1, 4, 0, data)
+	value := func(idx int) float32 {
+		return math.Float32frombits(binary.BigEndian.Uint32(data[1+idx*2:]))
+	}
+	for _, tc := range []struct {
+		name string
+		idx  int
+		want float32
+	}{
+		{"voltage", 0, 241.5},
+		{"power", 12, 1500},
+		{"import energy", 72, 1234},
+	} {
+		if v := value(tc.idx); v != tc.want {
+			t.Errorf("expected %s %v, got %v", tc.name, tc.want, v)
+		}
+	}
+}
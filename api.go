@@ -0,0 +1,261 @@
+package main
+
+/* JSON API for the cached register tables.
+ * Reads are served from the devices map. Writes are passed to the upstream device by the
+ * collector and are only allowed with the configured token and for allow-listed registers.
+ */
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zathras777/modbusdev"
+)
+
+type apiRegisters struct {
+	Device byte     `json:"device"`
+	Table  string   `json:"table"`
+	Start  int      `json:"start"`
+	Values []uint16 `json:"values"`
+}
+
+type apiField struct {
+	Name     string  `json:"name"`
+	Idx      int     `json:"idx"`
+	Units    string  `json:"units,omitempty"`
+	Value    float64 `json:"value"`
+	DeviceID byte    `json:"device"`
+}
+
+type apiDevice struct {
+	ID     byte     `json:"id"`
+	Tables []string `json:"tables"`
+}
+
+type apiRequest struct {
+	Device   byte      `json:"device"`
+	Table    string    `json:"table"`
+	Start    int       `json:"start"`
+	Count    int       `json:"count"`
+	Requests int       `json:"requests"`
+	Last     time.Time `json:"last"`
+	Polled   bool      `json:"polled"`
+}
+
+var tableFunctions = map[string]byte{"holding": 3, "input": 4}
+
+func tableName(fn byte) string {
+	return strings.ToLower(tableNames[fn])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("HTTP: unable to encode response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func apiDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	out := []apiDevice{}
+	for _, id := range deviceIDs() {
+		dev := apiDevice{ID: id}
+		for _, fn := range []byte{3, 4} {
+			if _, mErr := getRegisterAccess(id, fn); mErr == modbusSuccess {
+				dev.Tables = append(dev.Tables, tableName(fn))
+			}
+		}
+		out = append(out, dev)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// apiRequestsHandler lists the ranges read by the master and whether they are polled.
+func apiRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	out := []apiRequest{}
+	for _, rr := range requestedRanges() {
+		out = append(out, apiRequest{Device: rr.key.unit, Table: tableName(rr.key.function), Start: int(rr.key.start),
+			Count: int(rr.key.count), Requests: rr.requests, Last: rr.last, Polled: rr.covered})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func apiFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	regA, mErr := getRegisterAccess(cfg.Source.DeviceID, 4)
+	if mErr != modbusSuccess {
+		writeAPIError(w, http.StatusNotFound, "source device %d: %s", cfg.Source.DeviceID, mErr)
+		return
+	}
+	out := []apiField{}
+	var v modbusdev.Value
+	for _, fld := range cfg.Source.Fields {
+		data, mErr := regA.Read(fld.Idx, 2)
+		if mErr != modbusSuccess {
+			continue
+		}
+		v.FormatBytes("ieee32", data[1:])
+		out = append(out, apiField{Name: fld.Name, Idx: fld.Idx, Units: fld.Units, Value: v.Ieee32,
+			DeviceID: cfg.Source.DeviceID})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// parseRegisterPath returns the device and table function from the request path values.
+func parseRegisterPath(w http.ResponseWriter, r *http.Request) (byte, byte, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 8)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid device id %q", r.PathValue("id"))
+		return 0, 0, false
+	}
+	fn, ck := tableFunctions[r.PathValue("table")]
+	if !ck {
+		writeAPIError(w, http.StatusBadRequest, "unknown table %q, expected holding or input", r.PathValue("table"))
+		return 0, 0, false
+	}
+	return byte(id), fn, true
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func apiReadHandler(w http.ResponseWriter, r *http.Request) {
+	id, fn, ok := parseRegisterPath(w, r)
+	if !ok {
+		return
+	}
+	start, err := queryInt(r, "start", 0)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid start: %v", err)
+		return
+	}
+	count, err := queryInt(r, "count", 1)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid count: %v", err)
+		return
+	}
+	if start < 0 || count < 1 || start+count > len(registerData{}) {
+		writeAPIError(w, http.StatusBadRequest, "range %d+%d is outside the register table", start, count)
+		return
+	}
+	regA, mErr := getRegisterAccess(id, fn)
+	if mErr != modbusSuccess {
+		writeAPIError(w, http.StatusNotFound, "device %d: %s", id, mErr)
+		return
+	}
+	data, mErr := regA.Read(start, count)
+	if mErr != modbusSuccess {
+		writeAPIError(w, http.StatusBadRequest, "device %d: %s", id, mErr)
+		return
+	}
+	out := apiRegisters{Device: id, Table: tableName(fn), Start: start}
+	for n := 1; n+1 < len(data); n += 2 {
+		out.Values = append(out.Values, binary.BigEndian.Uint16(data[n:n+2]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func apiAuthorised(r *http.Request) bool {
+	cfg := currentConfig()
+	if cfg.HTTP.Token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.HTTP.Token)) == 1
+}
+
+// writeAllowed checks that every register being written is covered by an entry in the allow-list.
+func writeAllowed(id byte, start, count int) bool {
+	cfg := currentConfig()
+	for n := start; n < start+count; n++ {
+		found := false
+		for _, wr := range cfg.HTTP.Writable {
+			sType, sReg := getRegisterType(wr.Start)
+			_, fReg := getRegisterType(wr.Finish)
+			if wr.Device == id && sType == 4 && n >= int(sReg) && n <= int(fReg) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func apiWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorised(r) {
+		writeAPIError(w, http.StatusUnauthorized, "a valid token is required to write registers")
+		return
+	}
+	id, fn, ok := parseRegisterPath(w, r)
+	if !ok {
+		return
+	}
+	if fn != 3 {
+		writeAPIError(w, http.StatusBadRequest, "only holding registers can be written")
+		return
+	}
+	var req apiRegisters
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+	if len(req.Values) == 0 || req.Start < 0 || req.Start+len(req.Values) > len(registerData{}) {
+		writeAPIError(w, http.StatusBadRequest, "range %d+%d is outside the register table", req.Start, len(req.Values))
+		return
+	}
+	if !writeAllowed(id, req.Start, len(req.Values)) {
+		writeAPIError(w, http.StatusForbidden, "writing registers %d+%d on device %d is not allowed", req.Start, len(req.Values), id)
+		return
+	}
+	if err := writeUpstreamRegisters(id, uint16(req.Start), req.Values); errors.Is(err, errSplitOffsets) {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "%v", err)
+		return
+	}
+	log.Printf("HTTP: wrote %d registers from %d to device %d for %s", len(req.Values), req.Start, id, r.RemoteAddr)
+	req.Device = id
+	req.Table = tableName(fn)
+	writeJSON(w, http.StatusOK, req)
+}
+
+type apiCapture struct {
+	Enabled bool `json:"enabled"`
+}
+
+func apiCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !apiAuthorised(r) {
+			writeAPIError(w, http.StatusUnauthorized, "a valid token is required to change capture state")
+			return
+		}
+		var req apiCapture
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body: %v", err)
+			return
+		}
+		setCaptureEnabled(req.Enabled)
+	}
+	writeJSON(w, http.StatusOK, apiCapture{Enabled: captureEnabled()})
+}
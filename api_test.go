@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newAPITestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/devices/{id}/{table}", apiReadHandler)
+	mux.HandleFunc("POST /api/devices/{id}/{table}", apiWriteHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAPIReadRegisters(t *testing.T) {
+	regA := setupTestEnvironment(t)
+	if err := regA.Write(10, 2, []byte{0x12, 0x34, 0xab, 0xcd}); err != modbusSuccess {
+		t.Fatalf("register write failed: %v", err)
+	}
+	srv := newAPITestServer(t)
+
+	resp, err := http.Get(srv.URL + "/api/devices/1/input?start=10&count=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	var out apiRegisters
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Values) != 2 || out.Values[0] != 0x1234 || out.Values[1] != 0xabcd {
+		t.Fatalf("unexpected values %v", out.Values)
+	}
+}
+
+func TestAPIWriteRequiresTokenAndAllowList(t *testing.T) {
+	setupTestEnvironment(t)
+	appConfig.HTTP.Token = "secret"
+	appConfig.HTTP.Writable = []writableRange{{Device: 1, Start: 40001, Finish: 40005}}
+	srv := newAPITestServer(t)
+
+	for _, tc := range []struct {
+		token  string
+		body   string
+		status int
+	}{
+		{"", `{"start":0,"values":[1]}`, http.StatusUnauthorized},
+		{"wrong", `{"start":0,"values":[1]}`, http.StatusUnauthorized},
+		{"secret", `{"start":4,"values":[1,2]}`, http.StatusForbidden},
+		{"secret", `{"start":0,"values":[1]}`, http.StatusBadGateway},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/api/devices/1/holding", strings.NewReader(tc.body))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("token %q body %s: got status %d want %d", tc.token, tc.body, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+// holdingResponder answers FC3 and FC16 requests from the registers.
+func holdingResponder(regs []uint16) func([]byte) []byte {
+	return func(req []byte) []byte {
+		start := int(binary.BigEndian.Uint16(req[2:]))
+		count := int(binary.BigEndian.Uint16(req[4:]))
+		out := []byte{req[0], req[1]}
+		switch req[1] {
+		case 3:
+			out = append(out, byte(count*2))
+			for _, v := range regs[start : start+count] {
+				out = binary.BigEndian.AppendUint16(out, v)
+			}
+		case 16:
+			for n := 0; n < count; n++ {
+				regs[start+n] = binary.BigEndian.Uint16(req[7+n*2:])
+			}
+			out = append(out, req[2:6]...)
+		}
+		return binary.LittleEndian.AppendUint16(out, modbusCRC(out))
+	}
+}
+
+func TestAPIWriteUpstream(t *testing.T) {
+	setupTestEnvironment(t)
+	appConfig.HTTP.Token = "secret"
+	appConfig.HTTP.Writable = []writableRange{{Device: 1, Start: 40001, Finish: 40005}}
+
+	// The meter's port cannot be used by two transactions at once, so a write that did
+	// not wait for the poll in progress would fail.
+	regs := make([]uint16, 8)
+	port := newRTUPort(rtuData{Baudrate: 9600}, 100*time.Millisecond)
+	port.port = &chunkedPort{respond: holdingResponder(regs), chunk: 2, delay: time.Millisecond}
+	dev := newDevice(port, "test", 1)
+	act, _ := deviceActionFromConfig(regRange{Start: 40001, Finish: 40005})
+	bus := deviceBus{name: "test", port: port, devices: []device{dev}}
+	bussesMu.Lock()
+	deviceBusses = []deviceBus{bus}
+	bussesMu.Unlock()
+	t.Cleanup(func() {
+		bussesMu.Lock()
+		deviceBusses = nil
+		bussesMu.Unlock()
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				bus.poll(dev, act)
+			}
+		}
+	}()
+
+	srv := newAPITestServer(t)
+	for n := 0; n < 5; n++ {
+		req, _ := http.NewRequest("POST", srv.URL+"/api/devices/1/holding", strings.NewReader(`{"start":1,"values":[4660,43981]}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("write %d: got status %d", n, resp.StatusCode)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if regs[1] != 0x1234 || regs[2] != 0xabcd {
+		t.Errorf("upstream registers not written: %04x", regs)
+	}
+	regA, _ := getRegisterAccess(1, 3)
+	if data, _ := regA.Read(1, 2); string(data[1:]) != string([]byte{0x12, 0x34, 0xab, 0xcd}) {
+		t.Errorf("cached registers not updated: % x", data)
+	}
+}
+
+func TestAPIWriteAcrossOffsets(t *testing.T) {
+	setupTestEnvironment(t)
+	appConfig.HTTP.Token = "secret"
+	appConfig.HTTP.Writable = []writableRange{{Device: 1, Start: 40001, Finish: 40005}}
+
+	// Registers 0 and 1 are read from 0, and 2 and 3 from 102.
+	regs := make([]uint16, 110)
+	port := newRTUPort(rtuData{Baudrate: 9600}, 100*time.Millisecond)
+	port.port = &chunkedPort{respond: holdingResponder(regs), chunk: 8}
+	dev := newDevice(port, "test", 1)
+	for _, rng := range []regRange{{Start: 40001, Finish: 40003}, {Start: 40103, Finish: 40105, Offset: 100}} {
+		act, err := deviceActionFromConfig(rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev.actions = append(dev.actions, act)
+	}
+	bussesMu.Lock()
+	deviceBusses = []deviceBus{{name: "test", port: port, devices: []device{dev}}}
+	bussesMu.Unlock()
+	t.Cleanup(func() {
+		bussesMu.Lock()
+		deviceBusses = nil
+		bussesMu.Unlock()
+	})
+
+	srv := newAPITestServer(t)
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"start":1,"values":[1,2]}`, http.StatusBadRequest},
+		{`{"start":2,"values":[3,4]}`, http.StatusOK},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/api/devices/1/holding", strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("body %s: got status %d want %d", tc.body, resp.StatusCode, tc.status)
+		}
+	}
+	if regs[1] != 0 || regs[2] != 0 || regs[102] != 3 || regs[103] != 4 {
+		t.Errorf("wrong upstream registers written: %v %v", regs[:4], regs[100:104])
+	}
+}
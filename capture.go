@@ -0,0 +1,306 @@
+package main
+
+/* Traffic capture.
+ * Every frame received or sent by the server, and every transaction the clients make with
+ * upstream devices, can be recorded to a rotating JSON lines file and/or a pcap file.
+ * The pcap file wraps each RTU frame as Modbus/TCP on port 502 so that Wireshark's Modbus
+ * dissector decodes it without any configuration. Capture can be toggled at runtime via
+ * SIGUSR1 or the API.
+ */
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+type captureDirection string
+
+const (
+	serverRx captureDirection = "server-rx"
+	serverTx captureDirection = "server-tx"
+	clientTx captureDirection = "client-tx"
+	clientRx captureDirection = "client-rx"
+)
+
+type captureRecord struct {
+	Time      time.Time        `json:"time"`
+	Direction captureDirection `json:"dir"`
+	Port      string           `json:"port"`
+	Frame     string           `json:"frame"`
+	Decode    string           `json:"decode,omitempty"`
+}
+
+// rotatingFile is a file that is renamed with a numeric suffix once it exceeds maxSize.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	header  []byte
+
+	fh   *os.File
+	size int64
+}
+
+type trafficRecorder struct {
+	enabled atomic.Bool
+	mu      sync.Mutex
+	jsonl   *rotatingFile
+	pcap    *rotatingFile
+
+	// Per link state used to build plausible TCP streams for the pcap output, keyed by
+	// the port and the side (server or client), and by the direction for sequences.
+	seq     map[string]uint32
+	trans   map[string]uint16
+	streams map[string]uint16
+}
+
+var traffic = &trafficRecorder{seq: make(map[string]uint32), trans: make(map[string]uint16), streams: make(map[string]uint16)}
+
+const (
+	pcapLinkTypeRaw = 101
+	mbapPort        = 502
+	defaultCapMB    = 10
+	defaultCapKeep  = 5
+)
+
+func openRotatingFile(path string, maxMB, keep int, header []byte) (*rotatingFile, error) {
+	if maxMB <= 0 {
+		maxMB = defaultCapMB
+	}
+	if keep <= 0 {
+		keep = defaultCapKeep
+	}
+	rf := &rotatingFile{path: path, maxSize: int64(maxMB) << 20, keep: keep, header: header}
+	return rf, rf.open()
+}
+
+func (rf *rotatingFile) open() error {
+	fh, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	rf.fh = fh
+	rf.size = st.Size()
+	if rf.size == 0 && len(rf.header) > 0 {
+		n, err := fh.Write(rf.header)
+		rf.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.fh.Close()
+	for n := rf.keep - 1; n > 0; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, n), fmt.Sprintf("%s.%d", rf.path, n+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Write(data []byte) (int, error) {
+	if rf.size+int64(len(data)) > rf.maxSize && rf.size > int64(len(rf.header)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.fh.Write(data)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.fh.Close()
+}
+
+func pcapFileHeader() []byte {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	return hdr
+}
+
+func startCapture() error {
+	cfg := appConfig.Capture
+	if cfg.File != "" {
+		rf, err := openRotatingFile(cfg.File, cfg.MaxSize, cfg.Keep, nil)
+		if err != nil {
+			return fmt.Errorf("unable to open capture file: %v", err)
+		}
+		traffic.jsonl = rf
+	}
+	if cfg.Pcap != "" {
+		rf, err := openRotatingFile(cfg.Pcap, cfg.MaxSize, cfg.Keep, pcapFileHeader())
+		if err != nil {
+			return fmt.Errorf("unable to open pcap file: %v", err)
+		}
+		traffic.pcap = rf
+	}
+	setCaptureEnabled(cfg.Enabled)
+	return nil
+}
+
+func setCaptureEnabled(enabled bool) {
+	if traffic.enabled.Swap(enabled) != enabled {
+		log.Printf("Capture: traffic capture %s", map[bool]string{true: "enabled", false: "disabled"}[enabled])
+	}
+}
+
+func captureEnabled() bool {
+	return traffic.enabled.Load()
+}
+
+// recordFrame records a complete RTU frame, including the CRC.
+func recordFrame(dir captureDirection, port string, frame []byte) {
+	if !traffic.enabled.Load() {
+		return
+	}
+	rec := captureRecord{Time: time.Now(), Direction: dir, Port: port, Frame: hex.EncodeToString(frame),
+		Decode: decodeFrame(frame, dir == serverRx || dir == clientTx)}
+
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+	if traffic.jsonl == nil && traffic.pcap == nil {
+		log.Printf("Capture: %s %s: %s [%s]", rec.Port, rec.Direction, rec.Frame, rec.Decode)
+		return
+	}
+	if traffic.jsonl != nil {
+		line, _ := json.Marshal(rec)
+		if _, err := traffic.jsonl.Write(append(line, '\n')); err != nil {
+			log.Printf("Capture: %v", err)
+		}
+	}
+	if traffic.pcap != nil && len(frame) >= 4 {
+		if _, err := traffic.pcap.Write(traffic.pcapRecord(rec.Time, dir, port, frame)); err != nil {
+			log.Printf("Capture: %v", err)
+		}
+	}
+}
+
+// decodeFrame gives a short human readable description of a frame.
+func decodeFrame(frame []byte, isRequest bool) string {
+	if len(frame) < 4 {
+		return "short frame"
+	}
+	if modbusCRC(frame[:len(frame)-2]) != binary.LittleEndian.Uint16(frame[len(frame)-2:]) {
+		return "bad crc"
+	}
+	unit, fn, data := frame[0], frame[1], frame[2:len(frame)-2]
+	switch {
+	case fn&0x80 != 0 && len(data) > 0:
+		return fmt.Sprintf("unit %d fc %d exception %d", unit, fn&0x7f, data[0])
+	case isRequest && len(data) >= 4:
+		return fmt.Sprintf("unit %d fc %d register %d count %d", unit, fn,
+			binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4]))
+	case !isRequest && (fn == 3 || fn == 4) && len(data) > 0:
+		return fmt.Sprintf("unit %d fc %d %d bytes", unit, fn, data[0])
+	}
+	return fmt.Sprintf("unit %d fc %d", unit, fn)
+}
+
+// pcapRecord wraps the frame as Modbus/TCP in an IPv4 packet. The server port is
+// 10.0.0.2 talking to the master at 10.0.0.1, while clients are 10.0.1.1 talking to
+// devices at 10.0.1.2. Each port is a TCP stream of its own, from port 1502 for the
+// first port seen, 1503 for the next and so on. Caller must hold the mutex.
+func (tr *trafficRecorder) pcapRecord(when time.Time, dir captureDirection, port string, frame []byte) []byte {
+	pdu := frame[1 : len(frame)-2]
+	isRequest := dir == serverRx || dir == clientTx
+
+	link := port + string(dir)[:6]
+	if isRequest {
+		tr.trans[link]++
+	}
+	stream, ck := tr.streams[link]
+	if !ck {
+		stream = uint16(len(tr.streams))
+		tr.streams[link] = stream
+	}
+	mbap := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(mbap[0:], tr.trans[link])
+	binary.BigEndian.PutUint16(mbap[4:], uint16(len(pdu)+1))
+	mbap[6] = frame[0]
+	payload := append(mbap, pdu...)
+
+	src, dst := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+	if dir == clientTx || dir == clientRx {
+		src, dst = []byte{10, 0, 1, 1}, []byte{10, 0, 1, 2}
+	}
+	sport, dport := 1502+stream, uint16(mbapPort)
+	if !isRequest {
+		src, dst = dst, src
+		sport, dport = dport, sport
+	}
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], tr.seq[port+string(dir)])
+	peer := map[captureDirection]captureDirection{serverRx: serverTx, serverTx: serverRx, clientTx: clientRx, clientRx: clientTx}[dir]
+	binary.BigEndian.PutUint32(tcp[8:], tr.seq[port+string(peer)])
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tr.seq[port+string(dir)] += uint32(len(payload))
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)+len(payload)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+
+	pkt := append(append(ip, tcp...), payload...)
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(when.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(when.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	return append(rec, pkt...)
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for n := 0; n+1 < len(hdr); n += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[n:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// capturingTransporter records the frames exchanged by a client with the upstream device.
+type capturingTransporter struct {
+	modbus.Transporter
+	port string
+}
+
+func (ct *capturingTransporter) Send(aduRequest []byte) ([]byte, error) {
+	recordFrame(clientTx, ct.port, aduRequest)
+	aduResponse, err := ct.Transporter.Send(aduRequest)
+	if len(aduResponse) > 0 {
+		recordFrame(clientRx, ct.port, aduResponse)
+	}
+	return aduResponse, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordFrameWritesJSONAndPcap(t *testing.T) {
+	dir := t.TempDir()
+	appConfig = configData{}
+	appConfig.Capture = captureData{Enabled: true, File: filepath.Join(dir, "cap.jsonl"), Pcap: filepath.Join(dir, "cap.pcap")}
+	if err := startCapture(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		setCaptureEnabled(false)
+		traffic.jsonl.Close()
+		traffic.pcap.Close()
+		traffic.jsonl, traffic.pcap = nil, nil
+	})
+
+	recordFrame(serverRx, "/dev/ttyUSB0", []byte{1, 3, 0, 14, 0, 1, 229, 201})
+	recordFrame(serverTx, "/dev/ttyUSB0", []byte{1, 131, 2, 192, 241})
+
+	fh, err := os.Open(appConfig.Capture.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	var recs []captureRecord
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+	if recs[0].Decode != "unit 1 fc 3 register 14 count 1" {
+		t.Fatalf("unexpected request decode %q", recs[0].Decode)
+	}
+	if recs[1].Decode != "unit 1 fc 3 exception 2" {
+		t.Fatalf("unexpected response decode %q", recs[1].Decode)
+	}
+
+	pcap, err := os.ReadFile(appConfig.Capture.Pcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(pcap[20:]) != pcapLinkTypeRaw {
+		t.Fatalf("unexpected link type")
+	}
+	// Header, then the request: record header, IPv4, TCP, MBAP and a 5 byte PDU.
+	first := pcap[24:]
+	if incl := binary.LittleEndian.Uint32(first[8:]); incl != 20+20+7+5 {
+		t.Fatalf("unexpected packet length %d", incl)
+	}
+	if port := binary.BigEndian.Uint16(first[16+22:]); port != mbapPort {
+		t.Fatalf("expected request to port %d, got %d", mbapPort, port)
+	}
+}
+
+func TestPcapStreamsByPort(t *testing.T) {
+	tr := &trafficRecorder{seq: make(map[string]uint32), trans: make(map[string]uint16), streams: make(map[string]uint16)}
+	request, response := []byte{1, 3, 0, 14, 0, 1, 229, 201}, []byte{1, 131, 2, 192, 241}
+	type tcpHeader struct {
+		sport, dport uint16
+		seq, ack     uint32
+	}
+	packet := func(dir captureDirection, port string, frame []byte) tcpHeader {
+		tcp := tr.pcapRecord(time.Now(), dir, port, frame)[16+20:]
+		return tcpHeader{binary.BigEndian.Uint16(tcp[0:]), binary.BigEndian.Uint16(tcp[2:]),
+			binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:])}
+	}
+
+	a := packet(serverRx, "/dev/ttyUSB0", request)
+	b := packet(serverRx, "/dev/ttyUSB2", request)
+	aResp := packet(serverTx, "/dev/ttyUSB0", response)
+	bResp := packet(serverTx, "/dev/ttyUSB2", response)
+	if a.sport == b.sport {
+		t.Errorf("expected each port to be its own stream, both from port %d", a.sport)
+	}
+	if b.seq != 0 || aResp.seq != 0 || bResp.seq != 0 {
+		t.Errorf("expected each stream to start from 0, got %d, %d and %d", b.seq, aResp.seq, bResp.seq)
+	}
+	want := uint32(7 + len(request) - 3)
+	if aResp.ack != want || bResp.ack != want {
+		t.Errorf("expected each response to acknowledge its own request, %d, got %d and %d", want, aResp.ack, bResp.ack)
+	}
+	if aResp.dport != a.sport || bResp.dport != b.sport {
+		t.Errorf("expected responses to their own stream, got %d and %d", aResp.dport, bResp.dport)
+	}
+	if a2 := packet(serverRx, "/dev/ttyUSB0", request); a2.sport != a.sport || a2.seq != want {
+		t.Errorf("expected the next request to continue the stream, got %+v", a2)
+	}
+}
@@ -3,14 +3,20 @@ package main
 /* Each client represents an endpoint with one or more devices attached.
  * Each device is configured with the modbus ID and lists of register ranges to be
  * read and stored by the server.
- * One limitation is that the server can only store a single set of device data, so every
- * configured device ID MUST be unique across all configured clients.
+ * The server stores a single set of data for each ID it presents, so a device can be
+ * exposed as a different ID. The exposed IDs MUST be unique across all configured
+ * clients, but devices on different busses can share the same modbus ID.
+ * The devices on a bus share its port, which sends one request at a time, so writes
+ * from the API wait for any poll in progress rather than corrupting it.
  */
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/goburrow/modbus"
@@ -21,61 +27,91 @@ type deviceAction struct {
 	startRegister  uint16
 	finishRegister uint16
 	numRegs        uint16
+	offset         uint16
 	errors         int
+	failures       int
+	exception      modbusError
+	lastPoll       time.Time
+	lastAttempt    time.Time
 	delay          time.Duration
+	mu             sync.Mutex
 }
 
 type device struct {
 	id      byte
+	exposed byte
 	client  modbus.Client
-	actions []*deviceAction
+	// Packages requests for the device, sent by the transport.
+	packager  *modbus.RTUClientHandler
+	transport modbus.Transporter
+	mirror    bool
+	actions   []*deviceAction
 }
 
 type deviceBus struct {
+	name    string
+	cfg     rtuData
 	devices []device
+	port    *rtuPort
+	events  chan hotplugEvent
+	stop    chan struct{}
+	done    chan struct{}
 }
 
 var clientDevices []device
 var deviceBusses []deviceBus
+var bussesMu sync.RWMutex
 var maxErrors int = 10
+var failedRetryInterval = 30 * time.Second
 var defaultDelay time.Duration = 500
 
-func getRegisterType(num int) (typ int, reg uint16) {
+// parseRegister splits a register number such as 40001 into the type (4) and
+// zero based register (0).
+func parseRegister(num int) (typ int, reg uint16, err error) {
 	sVal := fmt.Sprintf("%d", num)
-	typ, err := strconv.Atoi(string(sVal[0]))
+	if len(sVal) < 2 {
+		return 0, 0, fmt.Errorf("invalid register number %d", num)
+	}
+	typ, err = strconv.Atoi(string(sVal[0]))
 	if err != nil {
-		log.Print(err)
+		return
 	}
 	regi, err := strconv.Atoi(string(sVal[1:]))
 	if err != nil {
-		log.Print(err)
+		return
+	}
+	if regi < 1 {
+		return 0, 0, fmt.Errorf("invalid register number %d", num)
 	}
 	reg = uint16(regi) - 1
 	return
 }
 
+func getRegisterType(num int) (typ int, reg uint16) {
+	typ, reg, err := parseRegister(num)
+	if err != nil {
+		log.Print(err)
+	}
+	return
+}
+
 func startClient(cfg rtuData) error {
-	bus := deviceBus{}
+	bus := deviceBus{name: cfg.Devicename, cfg: cfg, port: newRTUPort(cfg, time.Second),
+		stop: make(chan struct{}), done: make(chan struct{})}
+	if err := bus.port.Connect(); err != nil {
+		log.Printf("Unable to connect: %s\n", err)
+		return err
+	}
 	for _, dev := range cfg.Devices {
-		addStandardDevice(dev.ID)
-
-		handler := modbus.NewRTUClientHandler(cfg.Devicename)
-		handler.BaudRate = cfg.Baudrate
-		handler.DataBits = 8
-		handler.Parity = cfg.Parity
-		handler.StopBits = 1
-		handler.SlaveId = dev.ID
-		handler.Timeout = 1 * time.Second
-
-		err := handler.Connect()
-		if err != nil {
-			log.Printf("Unable to connect: %s\n", err)
-			return err
+		addStandardDevice(dev.exposedID())
+
+		cDev := newDevice(bus.port, cfg.Devicename, dev.ID)
+		cDev.exposed = dev.exposedID()
+		cDev.mirror = dev.Identification.Mirror
+		if cDev.exposed != dev.ID {
+			log.Printf("Device %d on %s exposed as device %d", dev.ID, cfg.Devicename, cDev.exposed)
 		}
 
-		//		defer handler.Close()
-		client := modbus.NewClient(handler)
-		cDev := device{id: dev.ID, client: client}
 		for _, rng := range dev.Ranges {
 			da, err := deviceActionFromConfig(rng)
 			if err != nil {
@@ -92,14 +128,48 @@ func startClient(cfg rtuData) error {
 	}
 	if len(bus.devices) == 0 {
 		log.Printf("No devices configured for device bus %s", cfg.Devicename)
+		bus.port.Close()
 		return nil
 	}
+	bus.events = hotplug.subscribe()
+	bussesMu.Lock()
 	deviceBusses = append(deviceBusses, bus)
-	//	fmt.Println("Starting collector for client data")
+	bussesMu.Unlock()
 	go bus.collect()
 	return nil
 }
 
+// newDevice returns a device, with no actions, for the unit ID on the port.
+func newDevice(port *rtuPort, name string, id byte) device {
+	packager := modbus.NewRTUClientHandler(name)
+	packager.SlaveId = id
+	transport := &capturingTransporter{port, name}
+	return device{id: id, exposed: id, client: modbus.NewClient2(packager, transport), packager: packager, transport: transport}
+}
+
+// currentBusses returns a copy of the running device busses.
+func currentBusses() []deviceBus {
+	bussesMu.RLock()
+	defer bussesMu.RUnlock()
+	return append([]deviceBus(nil), deviceBusses...)
+}
+
+// stopClients stops every collector and closes the serial ports they were using.
+func stopClients() {
+	bussesMu.Lock()
+	busses := deviceBusses
+	deviceBusses = nil
+	bussesMu.Unlock()
+
+	for _, bus := range busses {
+		close(bus.stop)
+		<-bus.done
+		hotplug.unsubscribe(bus.events)
+		bus.port.Close()
+		log.Printf("Stopped collector for %s", bus.name)
+	}
+}
+
 func deviceActionFromConfig(rng regRange) (*deviceAction, error) {
 	sType, startReg := getRegisterType(rng.Start)
 	fType, finishReg := getRegisterType(rng.Finish)
@@ -109,60 +179,182 @@ func deviceActionFromConfig(rng regRange) (*deviceAction, error) {
 	if finishReg < startReg {
 		return nil, fmt.Errorf("finish register was lower than start register??? %d vs %d", startReg, finishReg)
 	}
+	if rng.Offset < 0 || rng.Offset > int(startReg) {
+		return nil, fmt.Errorf("offset %d is not between 0 and the start register %d", rng.Offset, startReg)
+	}
 	delay := defaultDelay
 	if rng.Delay > 0 {
 		delay = time.Duration(rng.Delay)
 	}
-	return &deviceAction{opType: sType, startRegister: startReg, finishRegister: finishReg, numRegs: finishReg - startReg, delay: delay}, nil
+	return &deviceAction{opType: sType, startRegister: startReg, finishRegister: finishReg, numRegs: finishReg - startReg,
+		offset: uint16(rng.Offset), delay: delay}, nil
 }
 
 func (bus deviceBus) collect() {
+	defer close(bus.done)
 OuterLoop:
 	for {
 		for _, dev := range bus.devices {
+			if dev.mirror && mirrorDue(dev.exposed) {
+				dev.mirrorIdentity()
+			}
 			for _, act := range dev.actions {
-				if act.errors >= maxErrors {
-					log.Printf("Device %d: Skipping action %v due excessive errors", dev.id, act)
+				if !bus.checkAdapter() {
 					break OuterLoop
 				}
-				var (
-					results []byte
-					err     error
-					mErr    modbusError
-					regA    *registerAccess
-				)
-				switch act.opType {
-				case 3:
-					//log.Printf("ReadInputRegisters(%d, %d)", act.startRegister, act.numRegs)
-					results, err = dev.client.ReadInputRegisters(act.startRegister, act.numRegs)
-					regA, mErr = getRegisterAccess(dev.id, 4)
-				case 4:
-					//log.Printf("ReadHoldingRegisters(%d, %d)", act.startRegister, act.numRegs)
-					results, err = dev.client.ReadHoldingRegisters(act.startRegister, act.numRegs)
-					regA, mErr = getRegisterAccess(dev.id, 3)
-				}
-				if err != nil {
-					act.errors++
-					log.Printf("Device %d: %v failed: %c", dev.id, act, err)
-					continue
+				// A range that keeps failing is only retried occasionally, so the other
+				// ranges and devices on the bus are still polled.
+				if act.errorCount() < maxErrors || act.retryDue() {
+					bus.poll(dev, act)
+					if act.errorCount() == maxErrors {
+						log.Printf("Device %d: %v failed %d times, retrying every %v", dev.id, act, maxErrors, failedRetryInterval)
+					}
 				}
-				if len(results) == 0 {
-					continue
+				select {
+				case <-bus.stop:
+					break OuterLoop
+				case <-time.After(act.delay * time.Millisecond):
 				}
-				//log.Printf("Results: %d bytes, % x", len(results), results)
+			}
+		}
+	}
+}
 
-				if mErr != modbusSuccess {
-					log.Print(err)
-					continue
-				}
-				mErr = regA.Write(int(act.startRegister), int(act.numRegs), results)
-				if mErr != modbusSuccess {
-					log.Printf("Unable to write data to registers: %s", err)
-				}
-				time.Sleep(act.delay * time.Millisecond)
+// checkAdapter pauses the collector while the adapter for the bus is missing. Returns
+// false if the collector was stopped while waiting.
+func (bus deviceBus) checkAdapter() bool {
+	select {
+	case ev := <-bus.events:
+		if ev.added || !bus.cfg.isAdapter(ev.adapter) {
+			return true
+		}
+	default:
+		return true
+	}
+
+	log.Printf("Collector: adapter for %s removed, pausing", bus.name)
+	bus.port.Close()
+	cfg, ok := waitForAdapter(bus.cfg, bus.events, bus.stop)
+	if !ok {
+		return false
+	}
+	bus.port.setDevicename(cfg.Devicename)
+	for _, dev := range bus.devices {
+		for _, act := range dev.actions {
+			act.resetErrors()
+		}
+	}
+	log.Printf("Collector: resumed %s on %s", bus.name, cfg.Devicename)
+	return true
+}
+
+// poll performs a single action against the device and stores the results.
+func (bus deviceBus) poll(dev device, act *deviceAction) {
+	var (
+		results []byte
+		err     error
+		mErr    modbusError
+		regA    *registerAccess
+	)
+	start := time.Now()
+	results, err = dev.read(act)
+	regA, mErr = getRegisterAccess(dev.exposed, registerTable(act.opType))
+	pollLatency.observeDuration(start, bus.name)
+	if err != nil {
+		act.failed(upstreamError(err))
+		log.Printf("Device %d: %v failed: %v", dev.id, act, err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+	//log.Printf("Results: %d bytes, % x", len(results), results)
+
+	if mErr != modbusSuccess {
+		log.Printf("Device %d: no registers held for %v: %v", dev.exposed, act, mErr)
+		return
+	}
+	mErr = regA.Write(int(act.startRegister-act.offset), int(act.numRegs), results)
+	if mErr != modbusSuccess {
+		log.Printf("Unable to write data to registers: %s", mErr)
+	} else {
+		act.succeeded()
+	}
+}
+
+// read performs the action against the device, returning the register data.
+func (dev device) read(act *deviceAction) ([]byte, error) {
+	switch act.opType {
+	case 3:
+		//log.Printf("ReadInputRegisters(%d, %d)", act.startRegister, act.numRegs)
+		return dev.client.ReadInputRegisters(act.startRegister, act.numRegs)
+	case 4:
+		//log.Printf("ReadHoldingRegisters(%d, %d)", act.startRegister, act.numRegs)
+		return dev.client.ReadHoldingRegisters(act.startRegister, act.numRegs)
+	}
+	return nil, fmt.Errorf("unsupported register type %d", act.opType)
+}
+
+// registerTable returns the server table (function code) used for a register type, so
+// input registers (3xxxx) are stored in table 4 and holding registers (4xxxx) in table 3.
+func registerTable(typ int) byte {
+	if typ == 3 {
+		return 4
+	}
+	return 3
+}
+
+// functionRegisterBase returns the configuration register number of the first register
+// read by the function, or 0 if the function does not read registers.
+func functionRegisterBase(function byte) int {
+	switch function {
+	case 3:
+		return 40001
+	case 4:
+		return 30001
+	}
+	return 0
+}
+
+// registerNumber returns the configuration register number of the zero based register
+// in the table starting at base, such as 40001, with an extra digit beyond 9999.
+func registerNumber(base, reg int) int {
+	if reg >= 9999 {
+		return base/10000*100000 + reg + 1
+	}
+	return base + reg
+}
+
+// writeUpstreamRegisters writes holding registers to the upstream device exposed as the id
+// and then updates the cached copy so the new values are visible before the next poll.
+func writeUpstreamRegisters(id byte, start uint16, values []uint16) error {
+	data := make([]byte, len(values)*2)
+	for n, v := range values {
+		binary.BigEndian.PutUint16(data[n*2:], v)
+	}
+	for _, bus := range currentBusses() {
+		for _, dev := range bus.devices {
+			if dev.exposed != id {
+				continue
+			}
+			upstream, err := dev.upstreamBlock(4, start, uint16(len(values)))
+			if err != nil {
+				return fmt.Errorf("device %d: %w", id, err)
 			}
+			if _, err := dev.client.WriteMultipleRegisters(upstream, uint16(len(values)), data); err != nil {
+				return fmt.Errorf("device %d: write of %d registers from %d failed: %v", id, len(values), upstream, err)
+			}
+			regA, mErr := getRegisterAccess(id, 3)
+			if mErr != modbusSuccess {
+				return mErr
+			}
+			if mErr = regA.Write(int(start), len(values), data); mErr != modbusSuccess {
+				return mErr
+			}
+			return nil
 		}
 	}
+	return fmt.Errorf("device %d is not polled by any client", id)
 }
 
 func opString(op int) string {
@@ -176,6 +368,125 @@ func opString(op int) string {
 	}
 }
 
-func (act deviceAction) String() string {
-	return fmt.Sprintf("%s from %d to %d", opString(act.opType), act.startRegister, act.finishRegister)
+// failed counts a failed poll, keeping the exception returned by the device.
+func (act *deviceAction) failed(mErr modbusError) {
+	act.mu.Lock()
+	act.errors++
+	act.failures++
+	act.exception = mErr
+	act.lastAttempt = time.Now()
+	act.mu.Unlock()
+}
+
+// retryDue checks whether a range that keeps failing should be polled again.
+func (act *deviceAction) retryDue() bool {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+	return time.Since(act.lastAttempt) >= failedRetryInterval
+}
+
+func (act *deviceAction) resetErrors() {
+	act.mu.Lock()
+	act.errors = 0
+	act.exception = modbusSuccess
+	act.mu.Unlock()
+}
+
+// upstreamException returns the exception for registers of the action, if the device
+// answered its last poll with an exception or has stopped responding.
+func (act *deviceAction) upstreamException() modbusError {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+	if act.exception == gatewayTargetFailed && act.errors < maxErrors {
+		return modbusSuccess
+	}
+	return act.exception
+}
+
+// upstreamException returns the exception to pass on for a read of the registers of the
+// device exposed as the id, from the table read by the function.
+func upstreamException(id, function byte, start, count int) modbusError {
+	opType := 4
+	if function == 4 {
+		opType = 3
+	}
+	for _, bus := range currentBusses() {
+		for _, dev := range bus.devices {
+			if dev.exposed != id {
+				continue
+			}
+			for _, act := range dev.actions {
+				if act.opType != opType || start >= int(act.finishRegister-act.offset) || start+count <= int(act.startRegister-act.offset) {
+					continue
+				}
+				if mErr := act.upstreamException(); mErr != modbusSuccess {
+					return mErr
+				}
+			}
+		}
+	}
+	return modbusSuccess
+}
+
+func (act *deviceAction) succeeded() {
+	act.mu.Lock()
+	act.lastPoll = time.Now()
+	act.errors = 0
+	act.exception = modbusSuccess
+	act.mu.Unlock()
+}
+
+func (act *deviceAction) errorCount() int {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+	return act.errors
+}
+
+// failureCount returns the number of failed polls, which unlike the error count is never
+// reset.
+func (act *deviceAction) failureCount() int {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+	return act.failures
+}
+
+func (act *deviceAction) lastSuccess() time.Time {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+	return act.lastPoll
+}
+
+func (act *deviceAction) String() string {
+	s := fmt.Sprintf("%s from %d to %d", opString(act.opType), act.startRegister, act.finishRegister)
+	if act.offset != 0 {
+		s += fmt.Sprintf(" held from %d", act.startRegister-act.offset)
+	}
+	return s
+}
+
+// upstreamRegister returns the register of the device that the held register is read
+// from, for the register type.
+func (dev device) upstreamRegister(opType int, held uint16) uint16 {
+	for _, act := range dev.actions {
+		if act.opType == opType && held >= act.startRegister-act.offset && held < act.finishRegister-act.offset {
+			return held + act.offset
+		}
+	}
+	return held
+}
+
+// errSplitOffsets is returned for writes to held registers that are read from the device
+// with different offsets, so are not one block of registers on the device.
+var errSplitOffsets = errors.New("registers are read with different offsets, write each range separately")
+
+// upstreamBlock returns the register of the device that count held registers from held
+// are read from, as long as they are read from consecutive registers.
+func (dev device) upstreamBlock(opType int, held, count uint16) (uint16, error) {
+	upstream := dev.upstreamRegister(opType, held)
+	for n := uint16(1); n < count; n++ {
+		if dev.upstreamRegister(opType, held+n) != upstream+n {
+			return 0, fmt.Errorf("%d to %d: %w", held, held+count, errSplitOffsets)
+		}
+	}
+	return upstream, nil
 }
@@ -1,28 +1,98 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type regRange struct {
 	Start, Finish int
 	Delay         int
+	// The registers are held this many registers lower than they are read from the
+	// device, for meters whose registers lie beyond those held for each device.
+	Offset int `yaml:",omitempty"`
 }
 
+// Unit IDs 1 to 247 address a single device, 0 being the broadcast address.
+const maxUnitID = 247
+
 type remoteDevice struct {
-	ID     byte
-	Ranges []regRange
+	ID       byte
+	ExposeAs byte `yaml:"expose_as,omitempty"`
+	Ranges   []regRange
+	// The objects answered to Read Device Identification.
+	Identification identificationData `yaml:",omitempty"`
+}
+
+// exposedID returns the ID the device is presented as to the master.
+func (dev remoteDevice) exposedID() byte {
+	if dev.ExposeAs != 0 {
+		return dev.ExposeAs
+	}
+	return dev.ID
+}
+
+// exposedDeviceID returns the ID the device on the port is exposed as.
+func exposedDeviceID(cfg configData, port string, id byte) byte {
+	for _, client := range cfg.Clients {
+		for _, dev := range client.Devices {
+			if dev.ID == id && client.Devicename == port {
+				return dev.exposedID()
+			}
+		}
+	}
+	return id
 }
 
 type rtuData struct {
 	Devicename string
-	Baudrate   int
-	Parity     string
-	Devices    []remoteDevice
+	// Alternatively the port can be identified by the USB adapter's details.
+	Serial   string `yaml:",omitempty"`
+	VidPid   string `yaml:"vid_pid,omitempty"`
+	PortPath string `yaml:"port_path,omitempty"`
+
+	Baudrate int
+	Parity   string
+	Devices  []remoteDevice
+}
+
+// serverData is a port the server answers requests on, either a serial port or, if TCP
+// is set, a Modbus TCP listen address.
+type serverData struct {
+	rtuData `yaml:",inline"`
+	TCP     string `yaml:",omitempty"`
+	// The unit IDs answered on the port, or every unit if empty.
+	Units []byte `yaml:",flow,omitempty"`
+	// Other devices are on the same bus, so their traffic is expected.
+	Shared bool `yaml:",omitempty"`
+	Access accessData
+}
+
+// name returns the serial device or listen address of the port.
+func (sd serverData) name() string {
+	if sd.TCP != "" {
+		return sd.TCP
+	}
+	return sd.Devicename
+}
+
+// serves checks whether the unit is answered on the port.
+func (sd serverData) serves(unit byte) bool {
+	if len(sd.Units) == 0 {
+		return true
+	}
+	for _, id := range sd.Units {
+		if id == unit {
+			return true
+		}
+	}
+	return false
 }
 
 type mqttData struct {
@@ -33,6 +103,27 @@ type mqttData struct {
 	HassdiscoveryPrefix string `yaml:"hassdiscovery_prefix"`
 }
 
+type writableRange struct {
+	Device        byte
+	Start, Finish int
+}
+
+type httpData struct {
+	Listen    string
+	Dashboard bool
+	API       bool
+	Token     string
+	Writable  []writableRange
+}
+
+type captureData struct {
+	Enabled bool
+	File    string
+	Pcap    string
+	MaxSize int `yaml:"max_size"`
+	Keep    int
+}
+
 type recordField struct {
 	Name  string
 	Idx   int
@@ -42,39 +133,103 @@ type recordField struct {
 }
 
 type configData struct {
-	Name   string
-	Server rtuData
-	MQTT   mqttData
-	Source struct {
+	Name    string
+	Server  serverData
+	Servers []serverData
+	MQTT    mqttData
+	HTTP    httpData
+	Capture captureData
+	Source  struct {
 		DeviceID byte `yaml:"device_id"`
 		Fields   []recordField
 	}
-	Clients []rtuData
+	Clients    []rtuData
+	Learn      learnData
+	Virtual    []registerOverride
+	Layouts    []string
+	Aggregates []aggregateData
+	Simulator  simulatorData
+	layouts    map[string]*meterLayout
 }
 
-var appConfig configData
+// serverPorts returns the ports the server answers on, the server section being the
+// first if configured.
+func (cfg configData) serverPorts() []serverData {
+	var ports []serverData
+	if cfg.Server.name() != "" || cfg.Server.usesUSBSelector() {
+		ports = append(ports, cfg.Server)
+	}
+	return append(ports, cfg.Servers...)
+}
 
-func parseConfiguration(cfgFn string) (err error) {
-	appConfig.MQTT.QoS = 0
+var (
+	appConfig configData
+	configMu  sync.RWMutex
+)
 
+// currentConfig returns a copy of the running configuration, which may be replaced
+// at any time by a reload.
+func currentConfig() configData {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return appConfig
+}
+
+// loadConfiguration reads and validates the configuration file without changing the
+// running configuration. Strict rejects any keys that are not recognised.
+func loadConfiguration(cfgFn string, strict bool) (cfg configData, issues []configIssue, err error) {
 	cfgData, err := os.ReadFile(cfgFn)
 	if err != nil {
 		return
 	}
 
-	err = yaml.Unmarshal(cfgData, &appConfig)
-	if err != nil {
-		fmt.Println(err)
+	var root yaml.Node
+	if err = yaml.Unmarshal(cfgData, &root); err != nil {
 		return
 	}
+	dec := yaml.NewDecoder(bytes.NewReader(cfgData))
+	dec.KnownFields(strict)
+	if err = dec.Decode(&cfg); err != nil && err != io.EOF {
+		return
+	}
+	err = nil
 
 	var newFields []recordField
-	for _, fld := range appConfig.Source.Fields {
+	for _, fld := range cfg.Source.Fields {
 		fld.uid = strings.ReplaceAll(strings.ToLower(fld.Name), " ", "_")
-		fld.topic = fmt.Sprintf("%s/%s/%s/state", appConfig.MQTT.TopicPrefix, appConfig.Name, fld.uid)
+		fld.topic = fmt.Sprintf("%s/%s/%s/state", cfg.MQTT.TopicPrefix, cfg.Name, fld.uid)
 		newFields = append(newFields, fld)
 	}
-	appConfig.Source.Fields = newFields
-	//fmt.Println(appConfig)
+	cfg.Source.Fields = newFields
+	if cfg.layouts, err = loadMeterLayouts(cfg.Layouts); err != nil {
+		return
+	}
+
+	issues = validateConfiguration(&cfg, &root)
+
+	// Aggregates are presented by virtual registers on devices of their own.
+	cfg.Virtual = append(expandAggregates(cfg), cfg.Virtual...)
+	compileOverrides(cfg.Virtual)
 	return
 }
+
+func parseConfiguration(cfgFn string, strict bool) error {
+	cfg, issues, err := loadConfiguration(cfgFn, strict)
+	if err != nil {
+		return err
+	}
+	if err := logConfigIssues(cfgFn, issues); err != nil {
+		return err
+	}
+	if err := resolveUSBDevices(&cfg); err != nil {
+		return err
+	}
+	if err := loadLearnedRanges(cfg.Learn.File); err != nil {
+		return err
+	}
+	mergeLearnedRanges(&cfg, currentLearnedRanges())
+	configMu.Lock()
+	appConfig = cfg
+	configMu.Unlock()
+	return nil
+}
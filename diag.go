@@ -0,0 +1,224 @@
+package main
+
+/* Serial line diagnostics (FC8, FC11 and FC12).
+ * Each serial server port keeps the counters and event log described in the Modbus
+ * serial line specification, so standard test tools can assess the health of the link.
+ * The bus counters cover every frame seen on the port, including those for other devices
+ * on a shared bus, while the slave counters cover the requests for units exposed on the
+ * port. The counters are 16 bits and wrap, as on a real device. Diagnostics are answered
+ * with Illegal Function on TCP ports, as they have no serial line.
+ */
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/tbrandon/mbserver"
+)
+
+const (
+	funcDiagnostics         = 0x08
+	funcGetCommEventCounter = 0x0B
+	funcGetCommEventLog     = 0x0C
+
+	// FC8 sub-functions.
+	diagReturnQueryData          = 0x00
+	diagRestartCommunications    = 0x01
+	diagReturnDiagnosticRegister = 0x02
+	diagForceListenOnly          = 0x04
+	diagClearCounters            = 0x0A
+	diagBusMessageCount          = 0x0B
+	diagBusCommErrorCount        = 0x0C
+	diagBusExceptionCount        = 0x0D
+	diagSlaveMessageCount        = 0x0E
+	diagSlaveNoResponseCount     = 0x0F
+	diagSlaveNAKCount            = 0x10
+	diagSlaveBusyCount           = 0x11
+	diagBusCharOverrunCount      = 0x12
+	diagClearOverrun             = 0x14
+
+	// Comm event log entries.
+	eventReceive         = 0x80
+	eventReceiveError    = 0x02
+	eventListenOnly      = 0x20
+	eventBroadcast       = 0x40
+	eventSend            = 0x40
+	eventReadException   = 0x01
+	eventAbortException  = 0x02
+	eventBusyException   = 0x04
+	eventNAKException    = 0x08
+	eventEnterListenOnly = 0x04
+	eventRestart         = 0x00
+
+	commEventLogMax = 64
+)
+
+type portDiagnostics struct {
+	mu            sync.Mutex
+	busMessages   uint16
+	busErrors     uint16
+	exceptions    uint16
+	slaveMessages uint16
+	noResponses   uint16
+	naks          uint16
+	busy          uint16
+	events        uint16
+	// The comm event log, most recent first.
+	log        []byte
+	listenOnly bool
+}
+
+// isDiagnostic checks whether the frame is a FC8 request with the sub-function.
+func isDiagnostic(frame *mbserver.RTUFrame, sub uint16) bool {
+	return frame.Function == funcDiagnostics && len(frame.Data) >= 2 && binary.BigEndian.Uint16(frame.Data) == sub
+}
+
+// logEvent adds an entry to the comm event log. Must be called with the lock held.
+func (pd *portDiagnostics) logEvent(event byte) {
+	pd.log = append([]byte{event}, pd.log...)
+	if len(pd.log) > commEventLogMax {
+		pd.log = pd.log[:commEventLogMax]
+	}
+}
+
+// busMessage counts a valid frame seen on the bus.
+func (pd *portDiagnostics) busMessage() {
+	pd.mu.Lock()
+	pd.busMessages++
+	pd.mu.Unlock()
+}
+
+// busError counts a frame that failed the CRC check, or could not be framed.
+func (pd *portDiagnostics) busError() {
+	pd.mu.Lock()
+	pd.busErrors++
+	pd.logEvent(eventReceive | eventReceiveError)
+	pd.mu.Unlock()
+}
+
+// received counts a request for a unit exposed on the port, or a broadcast, returning
+// whether the port is in listen only mode.
+func (pd *portDiagnostics) received(broadcast bool) bool {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.slaveMessages++
+	event := byte(eventReceive)
+	if pd.listenOnly {
+		event |= eventListenOnly
+	}
+	if broadcast {
+		event |= eventBroadcast
+	}
+	pd.logEvent(event)
+	return pd.listenOnly
+}
+
+// unanswered counts a request for the port that was not answered.
+func (pd *portDiagnostics) unanswered() {
+	pd.mu.Lock()
+	pd.noResponses++
+	pd.mu.Unlock()
+}
+
+// answered counts the response to a request.
+func (pd *portDiagnostics) answered(function byte, err modbusError) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	event := byte(eventSend)
+	switch err {
+	case modbusSuccess:
+		if function != funcGetCommEventCounter {
+			pd.events++
+		}
+	case illegalFunction, illegalAddress, illegalDataValue:
+		event |= eventReadException
+	case serverDeviceFailure:
+		event |= eventAbortException
+	case acknowledge, serverDeviceBusy:
+		event |= eventBusyException
+		pd.busy++
+	case negativeAcknowledge:
+		event |= eventNAKException
+		pd.naks++
+	}
+	if err != modbusSuccess {
+		pd.exceptions++
+	}
+	pd.logEvent(event)
+}
+
+// clear resets the counters, and the event log if requested.
+func (pd *portDiagnostics) clear(clearLog bool) {
+	pd.busMessages, pd.busErrors, pd.exceptions, pd.slaveMessages = 0, 0, 0, 0
+	pd.noResponses, pd.naks, pd.busy, pd.events = 0, 0, 0, 0
+	if clearLog {
+		pd.log = nil
+	}
+}
+
+// diagnostic performs a FC8, FC11 or FC12 request, returning the data for the response.
+func (pd *portDiagnostics) diagnostic(frame *mbserver.RTUFrame) ([]byte, modbusError) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	switch frame.Function {
+	case funcGetCommEventCounter:
+		return binary.BigEndian.AppendUint16([]byte{0, 0}, pd.events), modbusSuccess
+	case funcGetCommEventLog:
+		out := []byte{byte(6 + len(pd.log)), 0, 0}
+		out = binary.BigEndian.AppendUint16(out, pd.events)
+		out = binary.BigEndian.AppendUint16(out, pd.busMessages)
+		return append(out, pd.log...), modbusSuccess
+	}
+
+	if len(frame.Data) != 4 {
+		return nil, illegalDataValue
+	}
+	sub := binary.BigEndian.Uint16(frame.Data[0:2])
+	value := binary.BigEndian.Uint16(frame.Data[2:4])
+	var count uint16
+	switch sub {
+	case diagReturnQueryData:
+		return frame.Data, modbusSuccess
+	case diagRestartCommunications:
+		if value != 0 && value != 0xff00 {
+			return nil, illegalDataValue
+		}
+		pd.clear(value == 0xff00)
+		pd.listenOnly = false
+		pd.logEvent(eventRestart)
+		return frame.Data, modbusSuccess
+	case diagForceListenOnly:
+		pd.listenOnly = true
+		pd.logEvent(eventEnterListenOnly)
+		return frame.Data, modbusSuccess
+	}
+	if value != 0 {
+		return nil, illegalDataValue
+	}
+	switch sub {
+	case diagReturnDiagnosticRegister:
+		// No diagnostic conditions are reported.
+	case diagClearCounters:
+		pd.clear(false)
+	case diagBusMessageCount:
+		count = pd.busMessages
+	case diagBusCommErrorCount:
+		count = pd.busErrors
+	case diagBusExceptionCount:
+		count = pd.exceptions
+	case diagSlaveMessageCount:
+		count = pd.slaveMessages
+	case diagSlaveNoResponseCount:
+		count = pd.noResponses
+	case diagSlaveNAKCount:
+		count = pd.naks
+	case diagSlaveBusyCount:
+		count = pd.busy
+	case diagBusCharOverrunCount, diagClearOverrun:
+		// Frames are read into a buffer, so characters are never overrun.
+	default:
+		return nil, illegalFunction
+	}
+	return binary.BigEndian.AppendUint16(append([]byte(nil), frame.Data[0:2]...), count), modbusSuccess
+}
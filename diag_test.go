@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/tbrandon/mbserver"
+)
+
+func TestDiagnosticCounters(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(4)
+	sp := &serverPort{cfg: serverData{Units: []byte{4}, Shared: true}, name: "diag", requests: make(chan *request, 8)}
+
+	// Two requests for our unit, a poll of another meter with its response, a bad
+	// frame and a broadcast.
+	var bus bytes.Buffer
+	bus.Write(withCRC(4, 4, 0, 0, 0, 2))
+	bus.Write(withCRC(4, 4, 1, 0, 0, 1))
+	bus.Write(withCRC(7, 3, 0, 0, 0, 1))
+	bus.Write(withCRC(7, 3, 2, 0, 9))
+	bus.Write([]byte{4, 4, 0, 0, 0, 1, 0, 0})
+	bus.Write(withCRC(0, 6, 0, 1, 0, 5))
+	if err := sp.acceptSerialRequests(readOnlyPort{&bus}); err != io.EOF {
+		t.Fatal(err)
+	}
+	for len(sp.requests) > 0 {
+		sp.handleRequest((<-sp.requests).frame)
+	}
+
+	diag := func(sub, value uint16) []byte {
+		t.Helper()
+		data := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, sub), value)
+		out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcDiagnostics, Data: data})
+		if len(out) < 4 {
+			t.Fatalf("sub-function %d: no response", sub)
+		}
+		return out[2 : len(out)-2]
+	}
+	for _, tc := range []struct {
+		sub  uint16
+		want uint16
+	}{
+		{diagBusMessageCount, 5},
+		// A bad frame on a shared bus is only noticed as noise, and skipped.
+		{diagBusCommErrorCount, 0},
+		{diagBusExceptionCount, 1},
+		{diagSlaveMessageCount, 3 + 4},
+		{diagSlaveNoResponseCount, 1},
+	} {
+		if got := binary.BigEndian.Uint16(diag(tc.sub, 0)[2:]); got != tc.want {
+			t.Errorf("sub-function %d: expected %d, got %d", tc.sub, tc.want, got)
+		}
+	}
+	if got := diag(diagReturnQueryData, 0xa55a); string(got) != string([]byte{0, 0, 0xa5, 0x5a}) {
+		t.Errorf("expected the query data echoed, got % x", got)
+	}
+
+	out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcGetCommEventCounter})
+	if want := []byte{4, funcGetCommEventCounter, 0, 0, 0, 7}; string(out[:len(out)-2]) != string(want) {
+		t.Errorf("expected event counter % x, got % x", want, out)
+	}
+	out = sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcGetCommEventLog})
+	if len(out) < 11 || out[2] != byte(len(out)-5) || out[9] != eventReceive || out[10] != eventSend {
+		t.Errorf("unexpected event log % x", out)
+	}
+
+	diag(diagClearCounters, 0)
+	if got := binary.BigEndian.Uint16(diag(diagBusMessageCount, 0)[2:]); got != 0 {
+		t.Errorf("expected counters to be cleared, got %d", got)
+	}
+	if out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcDiagnostics, Data: []byte{0, 0x13, 0, 0}}); out[1] != 0x88 || out[2] != byte(illegalFunction) {
+		t.Errorf("expected an unknown sub-function to be refused, got % x", out)
+	}
+
+	// On a port of its own, a bad frame is a communication error.
+	sp = &serverPort{name: "dedicated", requests: make(chan *request, 8)}
+	if err := sp.acceptSerialRequests(readOnlyPort{bytes.NewReader([]byte{4, 4, 0, 0, 0, 1, 0, 0})}); err != io.EOF {
+		t.Fatal(err)
+	}
+	if sp.diag.busErrors != 1 || sp.diag.log[0] != eventReceive|eventReceiveError {
+		t.Errorf("expected a communication error, got %d, log % x", sp.diag.busErrors, sp.diag.log)
+	}
+}
+
+func TestListenOnlyMode(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(4)
+	sp := &serverPort{name: "listen"}
+
+	if out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcDiagnostics, Data: []byte{0, diagForceListenOnly, 0, 0}}); out != nil {
+		t.Errorf("expected no response to force listen only, got % x", out)
+	}
+	if out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: 4, Data: []byte{0, 0, 0, 1}}); out != nil {
+		t.Errorf("expected no response in listen only mode, got % x", out)
+	}
+	if out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcDiagnostics, Data: []byte{0, diagRestartCommunications, 0, 0}}); out != nil {
+		t.Errorf("expected no response to the restart in listen only mode, got % x", out)
+	}
+	if out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: 4, Data: []byte{0, 0, 0, 1}}); out == nil {
+		t.Error("expected a response once communications restarted")
+	}
+
+	tcp := &serverPort{cfg: serverData{TCP: ":502"}, name: "tcp"}
+	if out := tcp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: funcGetCommEventCounter}); out[1] != 0x8b || out[2] != byte(illegalFunction) {
+		t.Errorf("expected diagnostics to be refused on a TCP port, got % x", out)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+/* Register dump.
+ * Reads a range of registers from a device, using the same code as the collector, and
+ * prints each register decoded in the ways a meter might use it. Values that span two
+ * registers are shown in both word orders. Fields from a register map are shown beside
+ * the register they start at, to help when working out the fields for a meter.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxDumpRegisters is the most registers that can be read in a single request.
+const maxDumpRegisters = 125
+
+type dumpOptions struct {
+	port   rtuData
+	id     byte
+	rng    regRange
+	fields []recordField
+}
+
+// parseRegisterList parses an inclusive range of registers such as 30001-30020.
+func parseRegisterList(s string) (regRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(first)
+	if err != nil {
+		return regRange{}, fmt.Errorf("invalid register %q", first)
+	}
+	finish := start
+	if isRange {
+		if finish, err = strconv.Atoi(last); err != nil {
+			return regRange{}, fmt.Errorf("invalid register %q", last)
+		}
+	}
+	if finish < start || finish-start >= maxDumpRegisters {
+		return regRange{}, fmt.Errorf("%s: a range of 1 to %d registers is required", s, maxDumpRegisters)
+	}
+	return regRange{Start: start, Finish: finish + 1}, nil
+}
+
+// dumpPort finds the configured client that polls the device, so the dump uses the same
+// port settings.
+func dumpPort(cfg configData, id byte) (rtuData, remoteDevice, bool) {
+	for _, client := range cfg.Clients {
+		for _, dev := range client.Devices {
+			if dev.ID == id {
+				return client, dev, true
+			}
+		}
+	}
+	return rtuData{}, remoteDevice{}, false
+}
+
+// loadRegisterMap reads a list of fields, in the same format as the source fields.
+func loadRegisterMap(fn string) ([]recordField, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var regMap struct{ Fields []recordField }
+	if err := yaml.Unmarshal(data, &regMap); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return regMap.Fields, nil
+}
+
+func dumpRegisters(opts dumpOptions, w io.Writer) error {
+	act, err := deviceActionFromConfig(opts.rng)
+	if err != nil {
+		return err
+	}
+	port := newRTUPort(opts.port, time.Second)
+	if err := port.Connect(); err != nil {
+		return fmt.Errorf("unable to open %s: %v", opts.port.Devicename, err)
+	}
+	defer port.Close()
+	dev := newDevice(port, opts.port.Devicename, opts.id)
+
+	data, err := dev.read(act)
+	if err != nil {
+		return fmt.Errorf("device %d: %v failed: %v", opts.id, act, err)
+	}
+	fields := opts.fields
+	if act.opType != 3 {
+		// Fields are indexes into the input registers.
+		fields = nil
+	}
+	return formatDump(w, opts.rng.Start, data, fields)
+}
+
+func printable(b byte) byte {
+	if b < 0x20 || b > 0x7e {
+		return '.'
+	}
+	return b
+}
+
+// formatDump prints a row for each register, starting at the register number first.
+func formatDump(w io.Writer, first int, data []byte, fields []recordField) error {
+	_, base, err := parseRegister(first)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]recordField)
+	for _, fld := range fields {
+		names[fld.Idx] = fld
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Register\tHex\tuint16\tint16\tint32\tint32 swapped\tfloat32\tfloat32 swapped\tASCII\t")
+	for n := 0; n+1 < len(data); n += 2 {
+		word := binary.BigEndian.Uint16(data[n:])
+		row := fmt.Sprintf("%d\t%04x\t%d\t%d\t", first+n/2, word, word, int16(word))
+		if n+3 < len(data) {
+			next := binary.BigEndian.Uint16(data[n+2:])
+			be := uint32(word)<<16 | uint32(next)
+			swapped := uint32(next)<<16 | uint32(word)
+			row += fmt.Sprintf("%d\t%d\t%g\t%g\t", int32(be), int32(swapped),
+				math.Float32frombits(be), math.Float32frombits(swapped))
+		} else {
+			row += "\t\t\t\t"
+		}
+		row += fmt.Sprintf("%c%c\t", printable(data[n]), printable(data[n+1]))
+		if fld, ck := names[int(base)+n/2]; ck && n+3 < len(data) {
+			row += fmt.Sprintf("  %s = %g %s", fld.Name, math.Float32frombits(binary.BigEndian.Uint32(data[n:])), fld.Units)
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseRegisterList(t *testing.T) {
+	rng, err := parseRegisterList("30001-30020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng.Start != 30001 || rng.Finish != 30021 {
+		t.Errorf("unexpected range %v", rng)
+	}
+	for _, bad := range []string{"", "30010-30001", "30001-30200", "3000x"} {
+		if _, err := parseRegisterList(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestFormatDump(t *testing.T) {
+	// 240.5 as a float32, then "OK".
+	data := []byte{0x43, 0x70, 0x80, 0x00, 'O', 'K'}
+	fields := []recordField{{Name: "Voltage", Idx: 10, Units: "V"}}
+	var buf bytes.Buffer
+	if err := formatDump(&buf, 30011, data, fields); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 rows, got:\n%s", buf.String())
+	}
+	for n, want := range [][]string{
+		{"30011", "4370", "17264", "1131446272", "240.5", "Cp", "Voltage = 240.5 V"},
+		{"30012", "8000", "-32768", "-2147463349", ".."},
+		{"30013", "4f4b", "20299", "OK"},
+	} {
+		for _, w := range want {
+			if !strings.Contains(lines[n+1], w) {
+				t.Errorf("row %d: %q not found in %q", n, w, lines[n+1])
+			}
+		}
+	}
+}
@@ -0,0 +1,463 @@
+//go:build linux
+
+package main
+
+/* End to end tests.
+ * Pseudo-terminal pairs stand in for the two RS485 adapters. The real server and client
+ * code open the terminal side, while the tests drive the other side as the meter and
+ * the inverter (master).
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	testMeterID       byte = 2
+	propagationLimit       = 3 * time.Second
+	cachedReadLimit        = 250 * time.Millisecond
+	testMasterTimeout      = time.Second
+)
+
+var learnerOnce sync.Once
+
+// testMeter answers FC3, FC4 and FC43 requests for a single device from its own registers.
+type testMeter struct {
+	id       byte
+	port     *os.File
+	mu       sync.Mutex
+	regs     map[byte][]uint16
+	identity []string
+	polls    int
+}
+
+func (tm *testMeter) set(fn byte, reg int, v uint16) {
+	tm.mu.Lock()
+	tm.regs[fn][reg] = v
+	tm.mu.Unlock()
+}
+
+func (tm *testMeter) pollCount() int {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.polls
+}
+
+func (tm *testMeter) serve() {
+	var pending []byte
+	buf := make([]byte, 64)
+	for {
+		n, err := tm.port.Read(buf)
+		if err != nil {
+			return
+		}
+		pending = append(pending, buf[:n]...)
+		for len(pending) >= rtuMinSz-1 {
+			size := rtuMinSz
+			if pending[1] == funcReadDeviceIdentification {
+				size = rtuMinSz - 1
+			} else if len(pending) < size {
+				break
+			}
+			raw := pending[:size]
+			pending = pending[size:]
+			if raw[0] != tm.id || binary.LittleEndian.Uint16(raw[size-2:]) != modbusCRC(raw[:size-2]) {
+				continue
+			}
+			tm.port.Write(tm.respond(raw))
+		}
+	}
+}
+
+func (tm *testMeter) respond(raw []byte) []byte {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.polls++
+	if raw[1] == funcReadDeviceIdentification {
+		return tm.identify(raw)
+	}
+	start := int(binary.BigEndian.Uint16(raw[2:]))
+	count := int(binary.BigEndian.Uint16(raw[4:]))
+	regs, ck := tm.regs[raw[1]]
+	var out []byte
+	switch {
+	case !ck:
+		out = []byte{raw[0], raw[1] | 0x80, 1}
+	case start+count > len(regs):
+		out = []byte{raw[0], raw[1] | 0x80, 2}
+	default:
+		out = []byte{raw[0], raw[1], byte(count * 2)}
+		for _, v := range regs[start : start+count] {
+			out = binary.BigEndian.AppendUint16(out, v)
+		}
+	}
+	return binary.LittleEndian.AppendUint16(out, modbusCRC(out))
+}
+
+func (tm *testMeter) identify(raw []byte) []byte {
+	out := []byte{raw[0], raw[1] | 0x80, 1}
+	if len(tm.identity) > 0 {
+		out = []byte{raw[0], raw[1], meiReadDeviceIdentification, 1, 1, 0, 0, byte(len(tm.identity))}
+		for n, v := range tm.identity {
+			out = append(append(out, byte(n), byte(len(v))), v...)
+		}
+	}
+	return binary.LittleEndian.AppendUint16(out, modbusCRC(out))
+}
+
+// ptyTransporter sends requests from the test master over the controlling side of a pty.
+type ptyTransporter struct {
+	port *os.File
+}
+
+func (pt *ptyTransporter) Send(adu []byte) ([]byte, error) {
+	if _, err := pt.port.Write(adu); err != nil {
+		return nil, err
+	}
+	pt.port.SetReadDeadline(time.Now().Add(testMasterTimeout))
+	var resp []byte
+	buf := make([]byte, 256)
+	for {
+		n, err := pt.port.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, buf[:n]...)
+		if len(resp) >= 3 && len(resp) >= expectedResponseSize(resp) {
+			return resp, nil
+		}
+	}
+}
+
+func expectedResponseSize(resp []byte) int {
+	if resp[1]&0x80 != 0 {
+		return 5
+	}
+	switch resp[1] {
+	case 1, 2, 3, 4:
+		return 5 + int(resp[2])
+	case funcReadDeviceIdentification:
+		if size := deviceIdentificationLength(resp); size > 0 {
+			return size
+		}
+		return len(resp) + 1
+	default:
+		return rtuMinSz
+	}
+}
+
+func newTestMaster(port *os.File, id byte) modbus.Client {
+	packager := modbus.NewRTUClientHandler("")
+	packager.SlaveId = id
+	return modbus.NewClient2(packager, &ptyTransporter{port})
+}
+
+func openTestPty(t *testing.T) (*os.File, string) {
+	t.Helper()
+	ptmx, name, err := openPty()
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %v", err)
+	}
+	return ptmx, name
+}
+
+// startProxy runs the server and a collector polling the test meter, returning the
+// master's side of the server port.
+func startProxy(t *testing.T, meter *testMeter) *os.File {
+	t.Helper()
+	meterPort, meterTty := openTestPty(t)
+	meter.port = meterPort
+	go meter.serve()
+	t.Cleanup(func() { meterPort.Close() })
+	return startProxyFor(t, meterTty, remoteDevice{ID: meter.id,
+		Ranges:         []regRange{{Start: 30001, Finish: 30011, Delay: 50}, {Start: 40001, Finish: 40005, Delay: 50}},
+		Identification: identificationData{Mirror: true, ModelName: "proxied"}})
+}
+
+// startProxyFor runs the server and a collector polling the device on the meter's bus,
+// returning the master's side of the server port.
+func startProxyFor(t *testing.T, meterTty string, dev remoteDevice) *os.File {
+	t.Helper()
+	masterPort, serverTty := openTestPty(t)
+
+	devices = make(map[byte]map[byte]*registerAccess)
+	appConfig = configData{
+		Server:  serverData{rtuData: rtuData{Devicename: serverTty, Baudrate: 9600, Parity: "N"}},
+		Clients: []rtuData{{Devicename: meterTty, Baudrate: 9600, Parity: "N", Devices: []remoteDevice{dev}}},
+	}
+	mirroredIdentities = make(map[byte]map[byte]string)
+	mirrorAttempts = make(map[byte]time.Time)
+	if err := startServer(); err != nil {
+		t.Fatal(err)
+	}
+	addStandardDevice(defaultServerDevice)
+	if err := startClient(appConfig.Clients[0]); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stopClients)
+	return masterPort
+}
+
+// rawRequest sends a request the goburrow client would refuse to, returning an exception
+// response as a modbus error.
+func rawRequest(port *os.File, adu []byte) ([]byte, error) {
+	resp, err := (&ptyTransporter{port}).Send(adu)
+	if err != nil {
+		return nil, err
+	}
+	if resp[1]&0x80 != 0 {
+		return nil, &modbus.ModbusError{FunctionCode: resp[1], ExceptionCode: resp[2]}
+	}
+	return resp, nil
+}
+
+func newTestMeter() *testMeter {
+	return &testMeter{id: testMeterID, regs: map[byte][]uint16{3: make([]uint16, 16), 4: make([]uint16, 16)}}
+}
+
+// waitForRegister polls the proxy until the register has the value, returning how long it took.
+func waitForRegister(t *testing.T, read func(uint16, uint16) ([]byte, error), reg uint16, want uint16) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < propagationLimit {
+		data, err := read(reg, 1)
+		if err == nil && binary.BigEndian.Uint16(data) == want {
+			return time.Since(start)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("register %d did not reach %d within %v", reg, want, propagationLimit)
+	return 0
+}
+
+func TestEndToEnd(t *testing.T) {
+	meter := newTestMeter()
+	meter.set(4, 0, 2400)
+	meter.set(4, 9, 500)
+	meter.set(3, 3, 0xbeef)
+	meter.identity = []string{"Test", "TM1"}
+	masterPort := startProxy(t, meter)
+	master := newTestMaster(masterPort, testMeterID)
+
+	t.Run("propagation", func(t *testing.T) {
+		waitForRegister(t, master.ReadInputRegisters, 0, 2400)
+		waitForRegister(t, master.ReadHoldingRegisters, 3, 0xbeef)
+		data, err := master.ReadInputRegisters(9, 1)
+		if err != nil || binary.BigEndian.Uint16(data) != 500 {
+			t.Errorf("expected input register 9 to be 500, got % x (%v)", data, err)
+		}
+
+		meter.set(4, 0, 2415)
+		took := waitForRegister(t, master.ReadInputRegisters, 0, 2415)
+		t.Logf("update reached the master in %v", took)
+	})
+
+	t.Run("cached reads", func(t *testing.T) {
+		polls := meter.pollCount()
+		start := time.Now()
+		for n := 0; n < 5; n++ {
+			if _, err := master.ReadInputRegisters(0, 10); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if took := time.Since(start) / 5; took > cachedReadLimit {
+			t.Errorf("reads took %v on average, expected less than %v", took, cachedReadLimit)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if meter.pollCount() == polls {
+			t.Error("collector stopped polling the meter")
+		}
+	})
+
+	t.Run("exceptions", func(t *testing.T) {
+		tests := []struct {
+			name string
+			read func() ([]byte, error)
+			want byte
+		}{
+			{"unsupported function", func() ([]byte, error) {
+				return master.ReadCoils(0, 1)
+			}, byte(illegalFunction)},
+			{"registers not held", func() ([]byte, error) {
+				return master.ReadInputRegisters(250, 10)
+			}, byte(illegalAddress)},
+			{"too many registers", func() ([]byte, error) {
+				return rawRequest(masterPort, withCRC(testMeterID, 4, 0, 0, 0, 126))
+			}, byte(illegalDataValue)},
+		}
+		for _, tc := range tests {
+			_, err := tc.read()
+			var mErr *modbus.ModbusError
+			if !errors.As(err, &mErr) {
+				t.Errorf("%s: expected a modbus exception, got %v", tc.name, err)
+				continue
+			}
+			if mErr.ExceptionCode != tc.want {
+				t.Errorf("%s: expected exception %d, got %d", tc.name, tc.want, mErr.ExceptionCode)
+			}
+		}
+	})
+
+	t.Run("identification", func(t *testing.T) {
+		packager := modbus.NewRTUClientHandler("")
+		packager.SlaveId = testMeterID
+		objects, err := readDeviceIdentification(packager, &ptyTransporter{masterPort}, identExtended)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if objects[0] != "Test" || objects[1] != "TM1" || objects[5] != "proxied" {
+			t.Errorf("expected the mirrored and configured objects, got %v", objects)
+		}
+	})
+
+	t.Run("ignored units", func(t *testing.T) {
+		// Neither a request for another unit nor a broadcast write is answered, so the
+		// next response the master sees is for its own request.
+		for _, frame := range [][]byte{withCRC(99, 4, 0, 0, 0, 1), withCRC(0, 6, 0, 200, 0x42, 0x42)} {
+			if _, err := masterPort.Write(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := master.ReadHoldingRegisters(200, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := binary.BigEndian.Uint16(data); v != 0x4242 {
+			t.Errorf("expected the broadcast write to be performed, got %04x", v)
+		}
+	})
+}
+
+func TestEndToEndSimulator(t *testing.T) {
+	// The simulator and the collector each open one side of the meter's bus.
+	simPort, simTty := openTestPty(t)
+	busPort, busTty := openTestPty(t)
+	go io.Copy(simPort, busPort)
+	go io.Copy(busPort, simPort)
+	t.Cleanup(func() {
+		simPort.Close()
+		busPort.Close()
+	})
+
+	// The simulator's registers are held in the same process, so the device is exposed
+	// under another ID to be sure the values come over the bus.
+	const exposedID = 5
+	masterPort := startProxyFor(t, busTty, remoteDevice{ID: testMeterID, ExposeAs: exposedID,
+		Ranges: []regRange{{Start: 30001, Finish: 30011, Delay: 50}, {Start: 40001, Finish: 40005, Delay: 50}}})
+	master := newTestMaster(masterPort, exposedID)
+
+	sim := simulatorData{DeviceID: testMeterID, Devicename: simTty, Baudrate: 9600, Parity: "N", Interval: 50,
+		Registers: []simRegister{
+			{Name: "Voltage", Register: 30001, Value: 240},
+			{Name: "Setting", Register: 40003, Type: "uint16", Value: 7},
+		}}
+	quit := make(chan bool)
+	done := make(chan error, 1)
+	go func() { done <- runSimulator(sim, quit) }()
+	t.Cleanup(func() {
+		close(quit)
+		if err := <-done; err != nil {
+			t.Errorf("simulator: %v", err)
+		}
+	})
+
+	waitForRegister(t, master.ReadHoldingRegisters, 2, 7)
+	data, err := master.ReadInputRegisters(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := math.Float32frombits(binary.BigEndian.Uint32(data)); v != 240 {
+		t.Errorf("expected voltage 240, got %v", v)
+	}
+
+	_, err = rawRequest(masterPort, withCRC(exposedID, 3, 0, 0, 0, 0))
+	var mErr *modbus.ModbusError
+	if !errors.As(err, &mErr) || mErr.ExceptionCode != byte(illegalDataValue) {
+		t.Errorf("expected an illegal data value exception, got %v", err)
+	}
+}
+
+func TestScanFindsMeter(t *testing.T) {
+	meter := newTestMeter()
+	meter.identity = []string{"Test", "TM1"}
+	port, tty := openTestPty(t)
+	defer port.Close()
+	meter.port = port
+	go meter.serve()
+
+	opts := scanOptions{ids: []byte{1, 2, 3}, timeout: 100 * time.Millisecond}
+	found, err := scanPort(opts, tty, 9600, "N")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected 1 device, found %d: %v", len(found), found)
+	}
+	sr := found[0]
+	if sr.id != testMeterID || len(sr.answers) != 3 || sr.identity[1] != "TM1" {
+		t.Errorf("unexpected responder %v", sr)
+	}
+	want := []regRange{{Start: 40001, Finish: 40017, Delay: 100}, {Start: 30001, Finish: 30017, Delay: 100}}
+	if len(sr.ranges) != len(want) || sr.ranges[0] != want[0] || sr.ranges[1] != want[1] {
+		t.Errorf("expected ranges %v, got %v", want, sr.ranges)
+	}
+}
+
+func TestDumpMeter(t *testing.T) {
+	meter := newTestMeter()
+	meter.set(3, 0, 0x4370)
+	meter.set(3, 1, 0x8000)
+	port, tty := openTestPty(t)
+	defer port.Close()
+	meter.port = port
+	go meter.serve()
+
+	var buf bytes.Buffer
+	opts := dumpOptions{port: rtuData{Devicename: tty, Baudrate: 9600, Parity: "N"}, id: testMeterID,
+		rng: regRange{Start: 40001, Finish: 40004}}
+	if err := dumpRegisters(opts, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "240.5") || strings.Count(out, "\n") != 4 {
+		t.Errorf("unexpected dump:\n%s", out)
+	}
+}
+
+func TestLearnPolledRanges(t *testing.T) {
+	meter := newTestMeter()
+	meter.set(4, 12, 1234)
+	masterPort := startProxy(t, meter)
+	master := newTestMaster(masterPort, testMeterID)
+
+	fn := filepath.Join(t.TempDir(), "learned.yaml")
+	configMu.Lock()
+	appConfig.Learn = learnData{Enabled: true, File: fn}
+	configMu.Unlock()
+	learnerOnce.Do(func() { go runLearner() })
+	t.Cleanup(func() { learned = nil })
+
+	waitForRegister(t, master.ReadInputRegisters, 12, 1234)
+	if !rangePolled(currentConfig(), pollKey{unit: testMeterID, function: 4, start: 12, count: 1}) {
+		t.Error("learned range not added to the configuration")
+	}
+	if err := loadLearnedRanges(fn); err != nil {
+		t.Fatal(err)
+	}
+	want := []remoteDevice{{ID: testMeterID, Ranges: []regRange{{Start: 30013, Finish: 30014, Delay: int(defaultDelay)}}}}
+	if got := currentLearnedRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected learned ranges %v, got %v", want, got)
+	}
+}
@@ -1,81 +1,88 @@
 package main
 
-// Exception codes.
-//type modbusError byte
+/* Modbus exception codes.
+ * A modbusError is the exception code returned to the master, or modbusSuccess. The
+ * collector converts exceptions from upstream devices to the same type, so they can be
+ * passed on to the master.
+ */
 
-//var (
-//	Success modbusError
-// IllegalFunction function code received in the query is not recognized or allowed by slave.
-//	IllegalFunction modbusError = 1
-// IllegalDataAddress data address of some or all the required entities are not allowed or do not exist in slave.
-//	IllegalDataAddress modbusError = 2
-//)
+import (
+	"errors"
+	"fmt"
 
-// IllegalDataValue value is not accepted by slave.
-//	IllegalDataValue Exception = 3
-// SlaveDeviceFailure Unrecoverable error occurred while slave was attempting to perform requested action.
-//	SlaveDeviceFailure Exception = 4
-// AcknowledgeSlave has accepted request and is processing it, but a long duration of time is required. This response is returned to prevent a timeout error from occurring in the master. Master can next issue a Poll Program Complete message to determine whether processing is completed.
-//	AcknowledgeSlave Exception = 5
-// SlaveDeviceBusy is engaged in processing a long-duration command. Master should retry later.
-//	SlaveDeviceBusy Exception = 6
-// NegativeAcknowledge Slave cannot perform the programming functions. Master should request diagnostic or error information from slave.
-//	NegativeAcknowledge Exception = 7
-// MemoryParityError Slave detected a parity error in memory. Master can retry the request, but service may be required on the slave device.
-//	MemoryParityError Exception = 8
-// GatewayPathUnavailable Specialized for Modbus gateways. Indicates a misconfigured gateway.
-//	GatewayPathUnavailable Exception = 10
-// GatewayTargetDeviceFailedtoRespond Specialized for Modbus gateways. Sent when slave fails to respond.
-//	GatewayTargetDeviceFailedtoRespond Exception = 11
-//)
-
-//func (e Exception) Error() string {
-//	return fmt.Sprintf("%d", e)
-//}
+	"github.com/goburrow/modbus"
+)
 
-//func (e Exception) String() string {
-//	var str string
-//	switch e {
-//	case Success:
-//		str = fmt.Sprintf("Success")
-//	case IllegalFunction:
-//		str = fmt.Sprintf("IllegalFunction")
-//	case IllegalDataAddress:
-//		str = fmt.Sprintf("IllegalDataAddress")
-//	case IllegalDataValue:
-//		str = fmt.Sprintf("IllegalDataValue")
-//	case SlaveDeviceFailure:
-//		str = fmt.Sprintf("SlaveDeviceFailure")
-//	case AcknowledgeSlave:
-//		str = fmt.Sprintf("AcknowledgeSlave")
-//	case SlaveDeviceBusy:
-//		str = fmt.Sprintf("SlaveDeviceBusy")
-//	case NegativeAcknowledge:
-//		str = fmt.Sprintf("NegativeAcknowledge")
-//	case MemoryParityError:
-//		str = fmt.Sprintf("MemoryParityError")
-//	case GatewayPathUnavailable:
-//		str = fmt.Sprintf("GatewayPathUnavailable")
-//	case GatewayTargetDeviceFailedtoRespond:
-//		str = fmt.Sprintf("GatewayTargetDeviceFailedtoRespond")
-//	default:
-//		str = fmt.Sprintf("unknown")
-//	}
-//	return str
-//}
+type modbusError byte
 
-type modbusError struct {
-	desc string
-	code byte
-}
+const (
+	modbusSuccess modbusError = 0x00
+	// The function code is not recognised or allowed.
+	illegalFunction modbusError = 0x01
+	// Some or all of the registers requested do not exist or are not allowed.
+	illegalAddress modbusError = 0x02
+	// A value in the request, such as the number of registers, is not valid.
+	illegalDataValue modbusError = 0x03
+	// An unrecoverable error occurred while performing the request.
+	serverDeviceFailure modbusError = 0x04
+	// The request was accepted, but will take a long time to complete.
+	acknowledge modbusError = 0x05
+	// The device is busy with a long running request, the master should retry later.
+	serverDeviceBusy modbusError = 0x06
+	// The device cannot perform the programming function requested.
+	negativeAcknowledge modbusError = 0x07
+	// A parity error was detected in the device's memory.
+	memoryParityError modbusError = 0x08
+	// The gateway has no path to the target device.
+	gatewayPathUnavailable modbusError = 0x0A
+	// The gateway's target device did not respond.
+	gatewayTargetFailed modbusError = 0x0B
 
-var (
-	modbusSuccess   modbusError = modbusError{"OK", 0x0}
-	illegalFunction modbusError = modbusError{"Illegal Function", 0x01}
-	illegalAddress  modbusError = modbusError{"Illegal Data Address", 0x02}
-	unknownDevice   modbusError = modbusError{"Gateway Target Device Failed to Respond", 0xE}
+	// The exception for a unit that is not held.
+	unknownDevice = gatewayPathUnavailable
 )
 
+func (err modbusError) String() string {
+	switch err {
+	case modbusSuccess:
+		return "OK"
+	case illegalFunction:
+		return "Illegal Function"
+	case illegalAddress:
+		return "Illegal Data Address"
+	case illegalDataValue:
+		return "Illegal Data Value"
+	case serverDeviceFailure:
+		return "Server Device Failure"
+	case acknowledge:
+		return "Acknowledge"
+	case serverDeviceBusy:
+		return "Server Device Busy"
+	case negativeAcknowledge:
+		return "Negative Acknowledge"
+	case memoryParityError:
+		return "Memory Parity Error"
+	case gatewayPathUnavailable:
+		return "Gateway Path Unavailable"
+	case gatewayTargetFailed:
+		return "Gateway Target Device Failed to Respond"
+	}
+	return fmt.Sprintf("Exception %d", byte(err))
+}
+
 func (err modbusError) Error() string {
-	return err.desc
+	return err.String()
+}
+
+// upstreamError returns the exception for an error from an upstream device. Exceptions
+// are passed on, while any other failure means the device did not respond.
+func upstreamError(err error) modbusError {
+	if err == nil {
+		return modbusSuccess
+	}
+	var mErr *modbus.ModbusError
+	if errors.As(err, &mErr) {
+		return modbusError(mErr.ExceptionCode)
+	}
+	return gatewayTargetFailed
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/tbrandon/mbserver"
+)
+
+func TestModbusErrorString(t *testing.T) {
+	for mErr, want := range map[modbusError]string{
+		modbusSuccess:          "OK",
+		illegalDataValue:       "Illegal Data Value",
+		serverDeviceBusy:       "Server Device Busy",
+		gatewayPathUnavailable: "Gateway Path Unavailable",
+		gatewayTargetFailed:    "Gateway Target Device Failed to Respond",
+		modbusError(0x0C):      "Exception 12",
+	} {
+		if got := mErr.Error(); got != want {
+			t.Errorf("%d: expected %q, got %q", byte(mErr), want, got)
+		}
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	exception := &modbus.ModbusError{FunctionCode: 0x84, ExceptionCode: 2}
+	for err, want := range map[error]modbusError{
+		nil:                                   modbusSuccess,
+		exception:                             illegalAddress,
+		fmt.Errorf("device 2: %w", exception): illegalAddress,
+		errors.New("serial: timeout"):         gatewayTargetFailed,
+	} {
+		if got := upstreamError(err); got != want {
+			t.Errorf("%v: expected %v, got %v", err, want, got)
+		}
+	}
+}
+
+func TestServerExceptions(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(4)
+	act := &deviceAction{opType: 3, startRegister: 100, finishRegister: 110, numRegs: 10}
+	bussesMu.Lock()
+	deviceBusses = []deviceBus{{name: "test", devices: []device{{id: 4, exposed: 4, actions: []*deviceAction{act}}}}}
+	bussesMu.Unlock()
+	defer func() {
+		bussesMu.Lock()
+		deviceBusses = nil
+		bussesMu.Unlock()
+	}()
+
+	sp := &serverPort{name: "test"}
+	request := func(function byte, data ...byte) []byte {
+		out := sp.handleRequest(&mbserver.RTUFrame{Address: 4, Function: function, Data: data})
+		return out[:len(out)-2]
+	}
+	tests := []struct {
+		name     string
+		function byte
+		data     []byte
+		want     []byte
+	}{
+		{"beyond the table", 4, []byte{0, 250, 0, 10}, []byte{4, 0x84, byte(illegalAddress)}},
+		{"no registers", 3, []byte{0, 0, 0, 0}, []byte{4, 0x83, byte(illegalDataValue)}},
+		{"too many registers", 3, []byte{0, 0, 0, 126}, []byte{4, 0x83, byte(illegalDataValue)}},
+		{"unsupported function", 1, []byte{0, 0, 0, 1}, []byte{4, 0x81, byte(illegalFunction)}},
+		{"write single register", 6, []byte{0, 2, 0x12, 0x34}, []byte{4, 6, 0, 2, 0x12, 0x34}},
+	}
+	for _, tc := range tests {
+		if got := request(tc.function, tc.data...); string(got) != string(tc.want) {
+			t.Errorf("%s: expected % x, got % x", tc.name, tc.want, got)
+		}
+	}
+	if got := request(3, 0, 2, 0, 1); string(got) != string([]byte{4, 3, 2, 0x12, 0x34}) {
+		t.Errorf("expected the written register, got % x", got)
+	}
+
+	// An exception from the upstream device is passed on for its registers.
+	act.failed(illegalAddress)
+	if got := request(4, 0, 105, 0, 2); string(got) != string([]byte{4, 0x84, byte(illegalAddress)}) {
+		t.Errorf("expected the upstream exception, got % x", got)
+	}
+	if got := request(4, 0, 90, 0, 2); got[1] != 4 {
+		t.Errorf("expected other registers to be read, got % x", got)
+	}
+
+	// A device that does not respond is only reported once the collector gives up.
+	act.failed(gatewayTargetFailed)
+	if got := request(4, 0, 105, 0, 2); got[1] != 4 {
+		t.Errorf("expected cached registers after a timeout, got % x", got)
+	}
+	for n := 0; n < maxErrors; n++ {
+		act.failed(gatewayTargetFailed)
+	}
+	if got := request(4, 0, 105, 0, 2); string(got) != string([]byte{4, 0x84, byte(gatewayTargetFailed)}) {
+		t.Errorf("expected gateway target failed, got % x", got)
+	}
+}
+
+func TestCollectorRetriesFailingRange(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(1)
+	saved := failedRetryInterval
+	failedRetryInterval = 50 * time.Millisecond
+	defer func() { failedRetryInterval = saved }()
+
+	// The meter is cut off, so every poll times out.
+	regs := []uint16{0x1234, 0, 0, 0}
+	meter := &chunkedPort{respond: func([]byte) []byte { return nil }, chunk: 16}
+	port := newRTUPort(rtuData{Baudrate: 9600}, 10*time.Millisecond)
+	port.port = meter
+	dev := newDevice(port, "test", 1)
+	act, _ := deviceActionFromConfig(regRange{Start: 40001, Finish: 40005, Delay: 1})
+	dev.actions = []*deviceAction{act}
+	bus := deviceBus{name: "test", port: port, devices: []device{dev}, stop: make(chan struct{}), done: make(chan struct{})}
+	go bus.collect()
+	defer func() {
+		close(bus.stop)
+		<-bus.done
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the range to fail", func() bool { return act.errorCount() >= maxErrors })
+	select {
+	case <-bus.done:
+		t.Fatal("collector stopped after the range kept failing")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the meter answers again, the range is polled as before.
+	port.mu.Lock()
+	meter.respond = holdingResponder(regs)
+	port.mu.Unlock()
+	waitFor("the range to recover", func() bool { return act.errorCount() == 0 })
+	regA, _ := getRegisterAccess(1, 3)
+	if data, _ := regA.Read(0, 1); string(data[1:]) != string([]byte{0x12, 0x34}) {
+		t.Errorf("expected the registers to be polled again, got % x", data)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+/* Expressions for virtual registers.
+ * An expression combines register values with + - * / and parentheses. A register is
+ * written {device:register}, or {device:register:type} if it is not the type of the
+ * virtual register, e.g. "{2:30013} + {3:30013}" or "{4:30001:int16} * 0.1".
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// registerRef is a value held in the registers of a device.
+type registerRef struct {
+	device   byte
+	register int
+	typ      string
+}
+
+// exprNode is a compiled expression, evaluated with a function to look up register values.
+type exprNode interface {
+	eval(lookup func(registerRef) (float64, error)) (float64, error)
+	refs() []registerRef
+}
+
+type exprNumber float64
+
+type exprRegister registerRef
+
+type exprNegate struct{ x exprNode }
+
+type exprBinary struct {
+	op   byte
+	l, r exprNode
+}
+
+func (n exprNumber) eval(func(registerRef) (float64, error)) (float64, error) { return float64(n), nil }
+func (n exprNumber) refs() []registerRef                                      { return nil }
+
+func (n exprRegister) eval(lookup func(registerRef) (float64, error)) (float64, error) {
+	return lookup(registerRef(n))
+}
+func (n exprRegister) refs() []registerRef { return []registerRef{registerRef(n)} }
+
+func (n exprNegate) eval(lookup func(registerRef) (float64, error)) (float64, error) {
+	v, err := n.x.eval(lookup)
+	return -v, err
+}
+func (n exprNegate) refs() []registerRef { return n.x.refs() }
+
+func (n exprBinary) eval(lookup func(registerRef) (float64, error)) (float64, error) {
+	l, err := n.l.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.r.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	}
+	if r == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return l / r, nil
+}
+func (n exprBinary) refs() []registerRef { return append(n.l.refs(), n.r.refs()...) }
+
+type exprParser struct {
+	src    string
+	pos    int
+	defTyp string
+}
+
+// parseExpression compiles the expression. Registers without a type are taken to be defTyp.
+func parseExpression(src, defTyp string) (exprNode, error) {
+	p := &exprParser{src: src, defTyp: defTyp}
+	node, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return node, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("expression %q at %d: %s", p.src, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// next returns the next operator, if it is one of ops, and moves past it.
+func (p *exprParser) next(ops string) (byte, bool) {
+	p.skipSpace()
+	if p.pos < len(p.src) && strings.IndexByte(ops, p.src[p.pos]) >= 0 {
+		p.pos++
+		return p.src[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *exprParser) sum() (exprNode, error) {
+	node, err := p.product()
+	for err == nil {
+		op, ok := p.next("+-")
+		if !ok {
+			break
+		}
+		var r exprNode
+		if r, err = p.product(); err == nil {
+			node = exprBinary{op, node, r}
+		}
+	}
+	return node, err
+}
+
+func (p *exprParser) product() (exprNode, error) {
+	node, err := p.unary()
+	for err == nil {
+		op, ok := p.next("*/")
+		if !ok {
+			break
+		}
+		var r exprNode
+		if r, err = p.unary(); err == nil {
+			node = exprBinary{op, node, r}
+		}
+	}
+	return node, err
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if _, ok := p.next("-"); ok {
+		x, err := p.unary()
+		return exprNegate{x}, err
+	}
+	if _, ok := p.next("("); ok {
+		node, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.next(")"); !ok {
+			return nil, p.errorf("missing )")
+		}
+		return node, nil
+	}
+	if _, ok := p.next("{"); ok {
+		return p.register()
+	}
+	return p.number()
+}
+
+func (p *exprParser) number() (exprNode, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.src) {
+			return nil, p.errorf("unexpected end")
+		}
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", p.src[start:p.pos])
+	}
+	return exprNumber(v), nil
+}
+
+// register parses the rest of a {device:register[:type]} reference.
+func (p *exprParser) register() (exprNode, error) {
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return nil, p.errorf("missing }")
+	}
+	parts := strings.Split(p.src[p.pos:p.pos+end], ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, p.errorf("registers are written {device:register} or {device:register:type}")
+	}
+	dev, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 8)
+	if err != nil {
+		return nil, p.errorf("invalid device %q", parts[0])
+	}
+	reg, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, p.errorf("invalid register %q", parts[1])
+	}
+	if _, _, err := parseRegister(reg); err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	ref := registerRef{device: byte(dev), register: reg, typ: p.defTyp}
+	if len(parts) == 3 {
+		ref.typ = strings.TrimSpace(parts[2])
+		if !validValueType(ref.typ) {
+			return nil, p.errorf("unknown value type %q", ref.typ)
+		}
+	}
+	p.pos += end + 1
+	return exprRegister(ref), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpressions(t *testing.T) {
+	values := map[registerRef]float64{
+		{2, 30013, "float32"}: 1200,
+		{3, 30013, "float32"}: -300,
+		{4, 30001, "int16"}:   2405,
+	}
+	lookup := func(ref registerRef) (float64, error) {
+		v, ck := values[ref]
+		if !ck {
+			return 0, fmt.Errorf("no value for %v", ref)
+		}
+		return v, nil
+	}
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"{2:30013} + {3:30013}", 900},
+		{"{2:30013} - -{3:30013}", 900},
+		{"{4:30001:int16} * 0.1", 240.5},
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"({2:30013} + {3:30013}) / 3", 300},
+	}
+	for _, tc := range tests {
+		expr, err := parseExpression(tc.src, "float32")
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if v, err := expr.eval(lookup); err != nil || v != tc.want {
+			t.Errorf("%s: expected %v got %v (%v)", tc.src, tc.want, v, err)
+		}
+	}
+
+	for _, bad := range []string{"", "1 +", "(1", "{2}", "{2:30013", "{2:30013:float16}", "1 $ 2", "{300:30001}"} {
+		if _, err := parseExpression(bad, "float32"); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+	expr, _ := parseExpression("{2:30013} / ({3:30013} + 300)", "float32")
+	if _, err := expr.eval(lookup); err == nil {
+		t.Error("expected an error for division by zero")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+/* RTU framing.
+ * RTU frames carry no length, so the length has to be worked out from the function code
+ * and, for some functions, a byte count within the frame. Requests and responses for the
+ * same function differ, so the direction must be known.
+ */
+
+import "encoding/binary"
+
+const rtuMaxSz = 256
+
+// rtuFrameLength returns the length of the frame at the start of the buffer. Returns 0
+// if more bytes are needed to tell, or -1 if the function code is not known.
+func rtuFrameLength(buf []byte, isRequest bool) int {
+	if len(buf) < 2 {
+		return 0
+	}
+	fn := buf[1]
+	// byteCount returns the length of a frame with a byte count at pos, followed by the data.
+	byteCount := func(pos, extra int) int {
+		if len(buf) <= pos {
+			return 0
+		}
+		return pos + 1 + int(buf[pos]) + extra + 2
+	}
+	if isRequest {
+		switch fn {
+		case 1, 2, 3, 4, 5, 6, 8:
+			return 8
+		case 7, 11, 12, 17:
+			return 4
+		case 15, 16:
+			return byteCount(6, 0)
+		case 22:
+			return 10
+		case 23:
+			return byteCount(10, 0)
+		case 24:
+			return 6
+		case 43:
+			return 7
+		}
+		return -1
+	}
+
+	if fn&0x80 != 0 {
+		return 5
+	}
+	switch fn {
+	case 1, 2, 3, 4, 12, 17, 23:
+		return byteCount(2, 0)
+	case 5, 6, 8, 11, 15, 16:
+		return 8
+	case 7:
+		return 5
+	case 22:
+		return 10
+	case 24:
+		if len(buf) < 4 {
+			return 0
+		}
+		return 4 + int(binary.BigEndian.Uint16(buf[2:4])) + 2
+	case 43:
+		return deviceIdentificationLength(buf)
+	}
+	return -1
+}
+
+// deviceIdentificationLength works through the objects in a FC43/14 response.
+func deviceIdentificationLength(buf []byte) int {
+	if len(buf) < 8 {
+		return 0
+	}
+	pos := 8
+	for n := 0; n < int(buf[7]); n++ {
+		if len(buf) < pos+2 {
+			return 0
+		}
+		pos += 2 + int(buf[pos+1])
+	}
+	return pos + 2
+}
+
+// validRTUFrame checks the CRC at the end of the frame.
+func validRTUFrame(frame []byte) bool {
+	return len(frame) >= 4 && modbusCRC(frame[:len(frame)-2]) == binary.LittleEndian.Uint16(frame[len(frame)-2:])
+}
@@ -3,12 +3,14 @@ module github.com/zathras777/meterproxy
 go 1.24
 
 require (
+	github.com/creack/pty v1.1.24
 	github.com/eclipse/paho.mqtt.golang v1.3.2
 	github.com/goburrow/modbus v0.1.0
 	github.com/goburrow/serial v0.1.0
 	github.com/tbrandon/mbserver v0.0.0-20170611213546-993e1772cc62
 	github.com/zathras777/modbusdev v0.0.0-20210215101226-4c7fb2f73e07
-	gopkg.in/yaml.v2 v2.4.0
+	golang.org/x/sys v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,115 @@
+package main
+
+/* Hotplug handling for USB serial adapters.
+ * The sysfs tree is polled and subscribers are told when adapters are removed or
+ * (re)appear. The server and collectors use this to pause while their adapter is missing
+ * and to reopen it once the same adapter returns, even if it now has a different tty name.
+ */
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type hotplugEvent struct {
+	adapter usbSerialAdapter
+	added   bool
+}
+
+type hotplugWatcher struct {
+	mu      sync.Mutex
+	present map[string]usbSerialAdapter
+	subs    map[chan hotplugEvent]bool
+}
+
+const hotplugInterval = 2 * time.Second
+
+var hotplug = &hotplugWatcher{subs: make(map[chan hotplugEvent]bool)}
+
+func (hw *hotplugWatcher) subscribe() chan hotplugEvent {
+	ch := make(chan hotplugEvent, 16)
+	hw.mu.Lock()
+	hw.subs[ch] = true
+	hw.mu.Unlock()
+	return ch
+}
+
+func (hw *hotplugWatcher) unsubscribe(ch chan hotplugEvent) {
+	hw.mu.Lock()
+	delete(hw.subs, ch)
+	hw.mu.Unlock()
+}
+
+// scan compares the adapters now present with the last scan and notifies subscribers
+// of any changes. The first scan only records what is present.
+func (hw *hotplugWatcher) scan(adapters []usbSerialAdapter) {
+	now := make(map[string]usbSerialAdapter)
+	for _, ua := range adapters {
+		now[ua.Tty] = ua
+	}
+
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.present == nil {
+		hw.present = now
+		return
+	}
+	var events []hotplugEvent
+	for tty, ua := range hw.present {
+		if _, ck := now[tty]; !ck {
+			log.Printf("Hotplug: %s removed", ua)
+			events = append(events, hotplugEvent{adapter: ua})
+		}
+	}
+	for tty, ua := range now {
+		if _, ck := hw.present[tty]; !ck {
+			log.Printf("Hotplug: %s added", ua)
+			events = append(events, hotplugEvent{adapter: ua, added: true})
+		}
+	}
+	hw.present = now
+
+	for _, ev := range events {
+		for ch := range hw.subs {
+			select {
+			case ch <- ev:
+			default:
+				log.Printf("Hotplug: dropped event for %s", ev.adapter.Tty)
+			}
+		}
+	}
+}
+
+func (hw *hotplugWatcher) run(root string, interval time.Duration) {
+	for {
+		hw.scan(scanUSBSerialAdapters(root))
+		time.Sleep(interval)
+	}
+}
+
+// isAdapter checks whether the adapter is the one used for the port. Adapters configured
+// by their USB details are matched on those, otherwise by the device name.
+func (rtu rtuData) isAdapter(ua usbSerialAdapter) bool {
+	if rtu.usesUSBSelector() {
+		return rtu.matches(ua)
+	}
+	return rtu.Devicename == filepath.Join("/dev", ua.Tty)
+}
+
+// waitForAdapter blocks until an adapter matching the port is added, returning the
+// port configuration with the current device name. Returns false if stopped.
+func waitForAdapter(rtu rtuData, events chan hotplugEvent, stop chan struct{}) (rtuData, bool) {
+	for {
+		select {
+		case <-stop:
+			return rtu, false
+		case ev := <-events:
+			if ev.added && rtu.isAdapter(ev.adapter) {
+				rtu.Devicename = filepath.Join("/dev", ev.adapter.Tty)
+				return rtu, true
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHotplugAdapterReturnsWithNewName(t *testing.T) {
+	hw := &hotplugWatcher{subs: make(map[chan hotplugEvent]bool)}
+	events := hw.subscribe()
+
+	adapter := usbSerialAdapter{Tty: "ttyUSB1", Serial: "A10KXYZ1", VendorID: "0403", ProductID: "6001", PortPath: "1-1.2"}
+	other := usbSerialAdapter{Tty: "ttyUSB0", Serial: "A10KXYZ2", VendorID: "0403", ProductID: "6001", PortPath: "1-1.3"}
+	hw.scan([]usbSerialAdapter{other, adapter})
+	if len(events) != 0 {
+		t.Fatalf("first scan should not generate events, got %d", len(events))
+	}
+
+	cfg := rtuData{Devicename: "/dev/ttyUSB1", Serial: "A10KXYZ1"}
+	hw.scan([]usbSerialAdapter{other})
+	ev := <-events
+	if ev.added || !cfg.isAdapter(ev.adapter) {
+		t.Fatalf("expected removal of the configured adapter, got %+v", ev)
+	}
+
+	// The adapter returns with a different tty name, after another adapter has taken its old one.
+	adapter.Tty = "ttyUSB2"
+	hw.scan([]usbSerialAdapter{other, adapter})
+	stop := make(chan struct{})
+	resumed, ok := waitForAdapter(cfg, events, stop)
+	if !ok || resumed.Devicename != "/dev/ttyUSB2" {
+		t.Fatalf("expected to resume on /dev/ttyUSB2, got %s (%v)", resumed.Devicename, ok)
+	}
+
+	byName := rtuData{Devicename: "/dev/ttyUSB0"}
+	if !byName.isAdapter(other) || byName.isAdapter(adapter) {
+		t.Fatal("adapters without a USB selector should match by device name")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+func startHTTPServer() error {
+	if appConfig.HTTP.Listen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	if appConfig.HTTP.Dashboard {
+		mux.HandleFunc("/", dashboardHandler)
+	}
+	if appConfig.HTTP.API {
+		mux.HandleFunc("GET /api/devices", apiDevicesHandler)
+		mux.HandleFunc("GET /api/fields", apiFieldsHandler)
+		mux.HandleFunc("GET /api/devices/{id}/{table}", apiReadHandler)
+		mux.HandleFunc("POST /api/devices/{id}/{table}", apiWriteHandler)
+		mux.HandleFunc("/api/capture", apiCaptureHandler)
+		mux.HandleFunc("GET /api/requests", apiRequestsHandler)
+	}
+
+	ln, err := net.Listen("tcp", appConfig.HTTP.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", appConfig.HTTP.Listen, err)
+	}
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("HTTP: %v", err)
+		}
+	}()
+	log.Printf("HTTP: Started listening on %s", appConfig.HTTP.Listen)
+	return nil
+}
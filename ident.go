@@ -0,0 +1,225 @@
+package main
+
+/* Device identification (FC43/14).
+ * Each exposed device answers Read Device Identification with its own objects. The basic
+ * objects (vendor name, product code and revision) are always present, defaulting to
+ * meterproxy's own. They, and the regular and extended objects, can be configured for
+ * each device, or mirrored from the upstream device by the collector. Configured values
+ * take precedence over mirrored ones, so a single object can be corrected.
+ * Objects are streamed by category, continuing from the next object when they do not
+ * all fit in one response, or read individually.
+ */
+
+import (
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+type identificationData struct {
+	// Read the objects from the upstream device.
+	Mirror              bool   `yaml:",omitempty"`
+	VendorName          string `yaml:"vendor_name,omitempty"`
+	ProductCode         string `yaml:"product_code,omitempty"`
+	Revision            string `yaml:",omitempty"`
+	VendorURL           string `yaml:"vendor_url,omitempty"`
+	ProductName         string `yaml:"product_name,omitempty"`
+	ModelName           string `yaml:"model_name,omitempty"`
+	UserApplicationName string `yaml:"user_application_name,omitempty"`
+	// Extended objects, 128 to 255.
+	Extended map[byte]string `yaml:",omitempty"`
+}
+
+const (
+	// Read device ID codes.
+	identBasic      = 1
+	identRegular    = 2
+	identExtended   = 3
+	identIndividual = 4
+
+	// The space for objects in a response, the largest PDU less the function code and header.
+	identObjectSpace = 253 - 7
+	// The longest value that fits in a response.
+	identMaxValue = identObjectSpace - 2
+
+	// How long the collector waits before trying to mirror the objects again.
+	identMirrorRetry = time.Minute
+)
+
+var (
+	mirroredIdentities = make(map[byte]map[byte]string)
+	mirrorAttempts     = make(map[byte]time.Time)
+	identitiesMu       sync.Mutex
+)
+
+// objects returns the configured objects by object ID.
+func (id identificationData) objects() map[byte]string {
+	objects := make(map[byte]string)
+	for n, v := range []string{id.VendorName, id.ProductCode, id.Revision, id.VendorURL, id.ProductName,
+		id.ModelName, id.UserApplicationName} {
+		if v != "" {
+			objects[byte(n)] = v
+		}
+	}
+	for n, v := range id.Extended {
+		objects[n] = v
+	}
+	return objects
+}
+
+// configuredIdentification returns the identification configured for an exposed device.
+func configuredIdentification(cfg configData, unit byte) identificationData {
+	for _, client := range cfg.Clients {
+		for _, dev := range client.Devices {
+			if dev.exposedID() == unit {
+				return dev.Identification
+			}
+		}
+	}
+	for _, agg := range cfg.Aggregates {
+		if agg.Device == unit {
+			return agg.Identification
+		}
+	}
+	return identificationData{}
+}
+
+// defaultRevision is the version meterproxy was built as, if known.
+func defaultRevision() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+// deviceIdentity returns every object for the exposed device.
+func deviceIdentity(unit byte) map[byte]string {
+	objects := map[byte]string{0: "meterproxy", 1: "meterproxy", 2: defaultRevision()}
+	identitiesMu.Lock()
+	for n, v := range mirroredIdentities[unit] {
+		objects[n] = v
+	}
+	identitiesMu.Unlock()
+	for n, v := range configuredIdentification(currentConfig(), unit).objects() {
+		objects[n] = v
+	}
+	return objects
+}
+
+// mirrorDue checks whether the collector should read the objects from the upstream
+// device, recording the attempt.
+func mirrorDue(unit byte) bool {
+	identitiesMu.Lock()
+	defer identitiesMu.Unlock()
+	if _, ck := mirroredIdentities[unit]; ck || time.Since(mirrorAttempts[unit]) < identMirrorRetry {
+		return false
+	}
+	mirrorAttempts[unit] = time.Now()
+	return true
+}
+
+func setMirroredIdentity(unit byte, objects map[byte]string) {
+	identitiesMu.Lock()
+	mirroredIdentities[unit] = objects
+	identitiesMu.Unlock()
+}
+
+// mirrorIdentity reads the objects from the upstream device, trying the basic objects
+// if the device does not give its extended objects. A device answering with an exception
+// has nothing to mirror, so is not asked again.
+func (dev device) mirrorIdentity() {
+	objects, err := readDeviceIdentification(dev.packager, dev.transport, identExtended)
+	if _, ck := err.(*modbus.ModbusError); ck {
+		objects, err = readDeviceIdentification(dev.packager, dev.transport, identBasic)
+	}
+	switch err.(type) {
+	case nil:
+		log.Printf("Device %d: mirrored %d identification objects", dev.id, len(objects))
+	case *modbus.ModbusError:
+		log.Printf("Device %d: no identification to mirror: %v", dev.id, err)
+	default:
+		log.Printf("Device %d: unable to read identification: %v", dev.id, err)
+		return
+	}
+	setMirroredIdentity(dev.exposed, objects)
+}
+
+// conformityLevel returns the highest category of objects held, with individual access.
+func conformityLevel(objects map[byte]string) byte {
+	level := byte(identBasic)
+	for n := range objects {
+		switch {
+		case n >= 0x80:
+			level = identExtended
+		case n >= 3 && level < identRegular:
+			level = identRegular
+		}
+	}
+	return 0x80 | level
+}
+
+// deviceIdentificationResponse answers a FC43/14 request for the unit, returning the
+// response data.
+func deviceIdentificationResponse(unit byte, data []byte) ([]byte, modbusError) {
+	if len(data) != 3 {
+		return nil, illegalDataValue
+	}
+	if data[0] != meiReadDeviceIdentification {
+		return nil, illegalFunction
+	}
+	code, first := data[1], data[2]
+	objects := deviceIdentity(unit)
+
+	var limit int
+	switch code {
+	case identBasic:
+		limit = 3
+	case identRegular:
+		limit = 0x80
+	case identExtended:
+		limit = 0x100
+	case identIndividual:
+		v, ck := objects[first]
+		if !ck {
+			return nil, illegalAddress
+		}
+		out := []byte{meiReadDeviceIdentification, code, conformityLevel(objects), 0, 0, 1, first, byte(len(v))}
+		return append(out, v...), modbusSuccess
+	default:
+		return nil, illegalDataValue
+	}
+
+	var ids []int
+	for n := range objects {
+		ids = append(ids, int(n))
+	}
+	sort.Ints(ids)
+	// A stream starting at an object that is not held starts again from the first.
+	if _, ck := objects[first]; !ck || int(first) >= limit {
+		first = 0
+	}
+
+	out := []byte{meiReadDeviceIdentification, code, conformityLevel(objects), 0, 0, 0}
+	space := identObjectSpace
+	for _, n := range ids {
+		if n < int(first) || n >= limit {
+			continue
+		}
+		v := objects[byte(n)]
+		if len(v) > identMaxValue {
+			v = v[:identMaxValue]
+		}
+		if 2+len(v) > space {
+			out[3], out[4] = 0xff, byte(n)
+			break
+		}
+		out = append(append(out, byte(n), byte(len(v))), v...)
+		space -= 2 + len(v)
+		out[5]++
+	}
+	return out, modbusSuccess
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceIdentificationResponse(t *testing.T) {
+	appConfig = configData{Clients: []rtuData{{Devices: []remoteDevice{
+		{ID: 1, ExposeAs: 4, Identification: identificationData{ProductCode: "SDM630", ModelName: "Grid",
+			Extended: map[byte]string{0x80: "site A"}}},
+	}}}}
+	mirroredIdentities = map[byte]map[byte]string{4: {0: "Eastron", 1: "mirrored", 2: "1.2"}}
+	defer func() { mirroredIdentities = make(map[byte]map[byte]string) }()
+
+	objects := func(data []byte) map[byte]string {
+		got := make(map[byte]string)
+		if _, err := parseDeviceIdentification(data, got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	data, mErr := deviceIdentificationResponse(4, []byte{meiReadDeviceIdentification, identBasic, 0})
+	if mErr != modbusSuccess {
+		t.Fatal(mErr)
+	}
+	if got := objects(data); len(got) != 3 || got[0] != "Eastron" || got[1] != "SDM630" || got[2] != "1.2" {
+		t.Errorf("unexpected basic objects %v", got)
+	}
+	if data[2] != 0x83 {
+		t.Errorf("expected extended conformity with individual access, got %02x", data[2])
+	}
+
+	data, _ = deviceIdentificationResponse(4, []byte{meiReadDeviceIdentification, identRegular, 0})
+	if got := objects(data); len(got) != 4 || got[5] != "Grid" {
+		t.Errorf("unexpected regular objects %v", got)
+	}
+	data, _ = deviceIdentificationResponse(4, []byte{meiReadDeviceIdentification, identExtended, 5})
+	if got := objects(data); len(got) != 2 || got[5] != "Grid" || got[0x80] != "site A" {
+		t.Errorf("unexpected extended objects from 5 %v", got)
+	}
+	data, _ = deviceIdentificationResponse(4, []byte{meiReadDeviceIdentification, identIndividual, 0x80})
+	if got := objects(data); len(got) != 1 || got[0x80] != "site A" {
+		t.Errorf("unexpected individual object %v", got)
+	}
+
+	// A device with nothing configured answers the defaults.
+	data, _ = deviceIdentificationResponse(9, []byte{meiReadDeviceIdentification, identBasic, 0})
+	if got := objects(data); got[0] != "meterproxy" || data[2] != 0x81 {
+		t.Errorf("unexpected default objects %v, conformity %02x", got, data[2])
+	}
+
+	for _, tc := range []struct {
+		data []byte
+		want modbusError
+	}{
+		{[]byte{meiReadDeviceIdentification, identIndividual, 0x81}, illegalAddress},
+		{[]byte{meiReadDeviceIdentification, 5, 0}, illegalDataValue},
+		{[]byte{0x0D, identBasic, 0}, illegalFunction},
+		{[]byte{meiReadDeviceIdentification, identBasic}, illegalDataValue},
+	} {
+		if _, mErr := deviceIdentificationResponse(4, tc.data); mErr != tc.want {
+			t.Errorf("% x: expected %v, got %v", tc.data, tc.want, mErr)
+		}
+	}
+}
+
+func TestDeviceIdentificationStreaming(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	appConfig = configData{Clients: []rtuData{{Devices: []remoteDevice{
+		{ID: 2, Identification: identificationData{Extended: map[byte]string{0x80: long, 0x90: long, 0xa0: "end"}}},
+	}}}}
+
+	got := make(map[byte]string)
+	next, responses := byte(0), 0
+	for {
+		data, mErr := deviceIdentificationResponse(2, []byte{meiReadDeviceIdentification, identExtended, next})
+		if mErr != modbusSuccess {
+			t.Fatal(mErr)
+		}
+		if len(data) > 252 {
+			t.Fatalf("response of %d bytes is too long", len(data))
+		}
+		responses++
+		var err error
+		if next, err = parseDeviceIdentification(data, got); err != nil {
+			t.Fatal(err)
+		}
+		if next == 0 {
+			break
+		}
+	}
+	if responses != 2 || len(got) != 6 || got[0x90] != long || got[0xa0] != "end" {
+		t.Errorf("expected every object in 2 responses, got %d objects in %d", len(got), responses)
+	}
+}
+
+func TestMirrorIdentityInChunks(t *testing.T) {
+	mirroredIdentities = make(map[byte]map[byte]string)
+	defer func() { mirroredIdentities = make(map[byte]map[byte]string) }()
+
+	// A real meter's response trickles in at 9600 baud.
+	port := newRTUPort(rtuData{Baudrate: 9600}, 100*time.Millisecond)
+	port.port = &chunkedPort{respond: identityResponder("Eastron", "SDM630-Modbus", "1.07"), chunk: 3, delay: 10 * time.Millisecond}
+	dev := newDevice(port, "test", 2)
+	dev.exposed = 5
+	dev.mirrorIdentity()
+
+	identitiesMu.Lock()
+	got := mirroredIdentities[5]
+	identitiesMu.Unlock()
+	if got[0] != "Eastron" || got[1] != "SDM630-Modbus" || got[2] != "1.07" {
+		t.Errorf("unexpected mirrored objects %v", got)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+/* Learning the ranges polled by the master.
+ * Every range the master reads is recorded. In learn mode, a range that no client polls
+ * is added to the client polling that device, so the cache covers whatever the master
+ * reads rather than returning zeros. Learned ranges are kept in a separate file, so the
+ * configuration file is never rewritten, and merged into the clients whenever the
+ * configuration is loaded.
+ */
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type learnData struct {
+	Enabled bool
+	File    string
+}
+
+type requestedRange struct {
+	key      pollKey
+	requests int
+	last     time.Time
+	covered  bool
+}
+
+const (
+	// The most ranges read by the master that are recorded. Beyond this, the least
+	// recently read range is forgotten.
+	maxRequestedRanges = 512
+	// The most registers a single learned range polls, the most a read can return.
+	maxLearnedRegisters = 125
+)
+
+var (
+	requested   = make(map[pollKey]*requestedRange)
+	requestedMu sync.Mutex
+
+	learned   []remoteDevice
+	learnedMu sync.Mutex
+	learnChan = make(chan pollKey, 16)
+)
+
+// devicePolledRanges returns the ranges polled for the device exposed as the id.
+func devicePolledRanges(cfg configData, id byte) (ranges []polledRange, found bool) {
+	for _, client := range cfg.Clients {
+		for _, dev := range client.Devices {
+			if dev.exposedID() != id {
+				continue
+			}
+			found = true
+			for _, rng := range dev.Ranges {
+				sType, sReg, sErr := parseRegister(rng.Start)
+				_, fReg, fErr := parseRegister(rng.Finish)
+				if sErr == nil && fErr == nil {
+					ranges = append(ranges, polledRange{opType: sType, start: int(sReg) - rng.Offset, end: int(fReg) - rng.Offset})
+				}
+			}
+		}
+	}
+	return
+}
+
+// rangePolled checks whether the configuration polls every register requested.
+func rangePolled(cfg configData, key pollKey) bool {
+	ranges, _ := devicePolledRanges(cfg, key.unit)
+	opType := 4
+	if key.function == 4 {
+		opType = 3
+	}
+	return rangeCovers(ranges, opType, int(key.start), int(key.count))
+}
+
+// recordRequestedRange notes a read by the master, passing it to the learner if no
+// client polls it.
+func recordRequestedRange(unit, function byte, start, count uint16) {
+	key := pollKey{unit: unit, function: function, start: start, count: count}
+	cfg := currentConfig()
+	covered := rangePolled(cfg, key)
+
+	requestedMu.Lock()
+	rr, ck := requested[key]
+	if !ck {
+		if len(requested) >= maxRequestedRanges {
+			forgetOldestRequest()
+		}
+		rr = &requestedRange{key: key}
+		requested[key] = rr
+		if !covered && len(cfg.Clients) > 0 {
+			log.Printf("Server: master read unit %d fc %d registers %d-%d, which are not polled",
+				unit, function, start, int(start)+int(count)-1)
+		}
+	}
+	rr.requests++
+	rr.last = time.Now()
+	rr.covered = covered
+	requestedMu.Unlock()
+
+	if !covered && cfg.Learn.Enabled {
+		select {
+		case learnChan <- key:
+		default:
+		}
+	}
+}
+
+// forgetOldestRequest removes the range least recently read by the master. Must be
+// called with the lock held.
+func forgetOldestRequest() {
+	var oldest *requestedRange
+	for _, rr := range requested {
+		if oldest == nil || rr.last.Before(oldest.last) {
+			oldest = rr
+		}
+	}
+	if oldest != nil {
+		delete(requested, oldest.key)
+	}
+}
+
+// requestedRanges returns the ranges read by the master, in order.
+func requestedRanges() []requestedRange {
+	requestedMu.Lock()
+	defer requestedMu.Unlock()
+	out := make([]requestedRange, 0, len(requested))
+	for _, rr := range requested {
+		out = append(out, *rr)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].key, out[j].key
+		if a.unit != b.unit {
+			return a.unit < b.unit
+		}
+		if a.function != b.function {
+			return a.function < b.function
+		}
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.count < b.count
+	})
+	return out
+}
+
+// learnedRange converts a request into a configuration range, if it can be cached, read
+// from offset registers higher than they are held.
+func learnedRange(key pollKey, offset int) (regRange, error) {
+	base := functionRegisterBase(key.function)
+	if base == 0 {
+		return regRange{}, fmt.Errorf("function %d can not be polled", key.function)
+	}
+	if int(key.start)+int(key.count) >= len(registerData{}) {
+		return regRange{}, fmt.Errorf("registers beyond %d are not held", len(registerData{})-1)
+	}
+	return regRange{Start: registerNumber(base, int(key.start)+offset), Finish: registerNumber(base, int(key.start)+int(key.count)+offset),
+		Delay: int(defaultDelay), Offset: offset}, nil
+}
+
+// learnedOffset returns the offset of the ranges polled from the table read by the
+// function for the device exposed as the id, as a learned range must be read from the
+// same registers of the device.
+func learnedOffset(cfg configData, id, function byte) (int, error) {
+	offset, found := 0, false
+	for _, client := range cfg.Clients {
+		for _, dev := range client.Devices {
+			if dev.exposedID() != id {
+				continue
+			}
+			for _, rng := range dev.Ranges {
+				if typ, _, err := parseRegister(rng.Start); err != nil || registerTable(typ) != function {
+					continue
+				}
+				if found && rng.Offset != offset {
+					return 0, fmt.Errorf("unit %d is polled with different offsets", id)
+				}
+				offset, found = rng.Offset, true
+			}
+		}
+	}
+	return offset, nil
+}
+
+// coalesceRanges merges overlapping and adjacent ranges of the same table, so long as the
+// merged range can still be read at once, returning the ranges in order.
+func coalesceRanges(ranges []regRange) []regRange {
+	sorted := append([]regRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	var out []regRange
+	for _, rng := range sorted {
+		if n := len(out) - 1; n >= 0 {
+			last := &out[n]
+			finish := max(last.Finish, rng.Finish)
+			lastType, _ := getRegisterType(last.Start)
+			rngType, _ := getRegisterType(rng.Start)
+			if lastType == rngType && last.Offset == rng.Offset && rng.Start <= last.Finish &&
+				finish-last.Start <= maxLearnedRegisters {
+				last.Finish = finish
+				last.Delay = min(last.Delay, rng.Delay)
+				continue
+			}
+		}
+		out = append(out, rng)
+	}
+	return out
+}
+
+// mergeLearnedRanges adds the learned ranges to the clients polling each device. Learned
+// devices are identified by the ID exposed to the master.
+func mergeLearnedRanges(cfg *configData, devs []remoteDevice) {
+	for _, ld := range devs {
+		for ci := range cfg.Clients {
+			for di := range cfg.Clients[ci].Devices {
+				dev := &cfg.Clients[ci].Devices[di]
+				if dev.exposedID() != ld.ID {
+					continue
+				}
+			RangeLoop:
+				for _, rng := range ld.Ranges {
+					for _, have := range dev.Ranges {
+						if have.Start == rng.Start && have.Finish == rng.Finish {
+							continue RangeLoop
+						}
+					}
+					dev.Ranges = append(dev.Ranges, rng)
+				}
+			}
+		}
+	}
+}
+
+// loadLearnedRanges reads the learned ranges kept from a previous run.
+func loadLearnedRanges(fn string) error {
+	if fn == "" {
+		return nil
+	}
+	data, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved struct{ Devices []remoteDevice }
+	if err := yaml.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	for n := range saved.Devices {
+		saved.Devices[n].Ranges = coalesceRanges(saved.Devices[n].Ranges)
+	}
+	learnedMu.Lock()
+	learned = saved.Devices
+	learnedMu.Unlock()
+	return nil
+}
+
+func saveLearnedRanges(fn string, devs []remoteDevice) error {
+	data, err := yaml.Marshal(struct{ Devices []remoteDevice }{devs})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fn), ".learned")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), fn)
+}
+
+// currentLearnedRanges returns a copy of the learned ranges.
+func currentLearnedRanges() []remoteDevice {
+	learnedMu.Lock()
+	defer learnedMu.Unlock()
+	out := make([]remoteDevice, len(learned))
+	for n, dev := range learned {
+		out[n] = remoteDevice{ID: dev.ID, Ranges: append([]regRange(nil), dev.Ranges...)}
+	}
+	return out
+}
+
+// learnRange adds the range to the collectors, if it is still not polled, and saves it.
+func learnRange(key pollKey) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg := currentConfig()
+	if !cfg.Learn.Enabled || rangePolled(cfg, key) {
+		return nil
+	}
+	if _, found := devicePolledRanges(cfg, key.unit); !found {
+		return fmt.Errorf("unit %d is not polled by any client", key.unit)
+	}
+	offset, err := learnedOffset(cfg, key.unit, key.function)
+	if err != nil {
+		return err
+	}
+	rng, err := learnedRange(key, offset)
+	if err != nil {
+		return err
+	}
+
+	learnedMu.Lock()
+	n := sort.Search(len(learned), func(i int) bool { return learned[i].ID >= key.unit })
+	if n == len(learned) || learned[n].ID != key.unit {
+		learned = append(learned[:n], append([]remoteDevice{{ID: key.unit}}, learned[n:]...)...)
+	}
+	learned[n].Ranges = coalesceRanges(append(learned[n].Ranges, rng))
+	learnedMu.Unlock()
+	devs := currentLearnedRanges()
+
+	log.Printf("Learn: polling registers %d-%d for unit %d", rng.Start, rng.Finish-1, key.unit)
+	cfg.Clients = cloneClients(cfg.Clients)
+	mergeLearnedRanges(&cfg, devs)
+	applyConfiguration(cfg)
+
+	if cfg.Learn.File != "" {
+		return saveLearnedRanges(cfg.Learn.File, devs)
+	}
+	return nil
+}
+
+// cloneClients copies the clients, so ranges can be added without changing the original.
+func cloneClients(clients []rtuData) []rtuData {
+	out := make([]rtuData, len(clients))
+	for ci, client := range clients {
+		out[ci] = client
+		out[ci].Devices = make([]remoteDevice, len(client.Devices))
+		for di, dev := range client.Devices {
+			out[ci].Devices[di] = dev
+			out[ci].Devices[di].Ranges = append([]regRange(nil), dev.Ranges...)
+		}
+	}
+	return out
+}
+
+// runLearner adds the ranges passed by the server as they are requested.
+func runLearner() {
+	failed := make(map[pollKey]bool)
+	for key := range learnChan {
+		if err := learnRange(key); err != nil && !failed[key] {
+			failed[key] = true
+			log.Printf("Learn: unable to learn fc %d registers %d-%d: %v", key.function, key.start,
+				int(key.start)+int(key.count)-1, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLearnedRange(t *testing.T) {
+	rng, err := learnedRange(pollKey{unit: 1, function: 3, start: 10, count: 4}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng.Start != 40011 || rng.Finish != 40015 {
+		t.Errorf("unexpected range %v", rng)
+	}
+	if _, err := learnedRange(pollKey{unit: 1, function: 4, start: 250, count: 10}, 0); err == nil {
+		t.Error("expected an error for registers that are not held")
+	}
+	if _, err := learnedRange(pollKey{unit: 1, function: 1, count: 1}, 0); err == nil {
+		t.Error("expected an error for coils")
+	}
+}
+
+func TestMergeLearnedRanges(t *testing.T) {
+	cfg := configData{Clients: []rtuData{{Devices: []remoteDevice{
+		{ID: 1, Ranges: []regRange{{Start: 30001, Finish: 30011}}},
+		{ID: 2},
+	}}}}
+	mergeLearnedRanges(&cfg, []remoteDevice{
+		{ID: 1, Ranges: []regRange{{Start: 30001, Finish: 30011}, {Start: 30021, Finish: 30023}}},
+		{ID: 3, Ranges: []regRange{{Start: 40001, Finish: 40002}}},
+	})
+	if got := cfg.Clients[0].Devices[0].Ranges; len(got) != 2 || got[1].Start != 30021 {
+		t.Errorf("unexpected ranges for device 1: %v", got)
+	}
+	if got := cfg.Clients[0].Devices[1].Ranges; len(got) != 0 {
+		t.Errorf("unexpected ranges for device 2: %v", got)
+	}
+	if !rangePolled(cfg, pollKey{unit: 1, function: 4, start: 20, count: 2}) {
+		t.Error("expected merged range to be polled")
+	}
+	if rangePolled(cfg, pollKey{unit: 1, function: 4, start: 20, count: 3}) {
+		t.Error("expected range beyond the merged range not to be polled")
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	got := coalesceRanges([]regRange{
+		{Start: 30021, Finish: 30023, Delay: 5},
+		{Start: 30001, Finish: 30011, Delay: 5},
+		{Start: 30011, Finish: 30015, Delay: 2},
+		{Start: 30013, Finish: 30017, Delay: 5},
+		// Only the same table is merged.
+		{Start: 40017, Finish: 40020, Delay: 5},
+		// Merged, the range would be more than can be read at once.
+		{Start: 30017, Finish: 30130, Delay: 5},
+	})
+	want := []regRange{
+		{Start: 30001, Finish: 30017, Delay: 2},
+		{Start: 30017, Finish: 30130, Delay: 5},
+		{Start: 40017, Finish: 40020, Delay: 5},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for n := range want {
+		if got[n] != want[n] {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestRequestedRangesLimit(t *testing.T) {
+	requested = make(map[pollKey]*requestedRange)
+	defer func() { requested = make(map[pollKey]*requestedRange) }()
+
+	for n := 0; n < maxRequestedRanges+10; n++ {
+		recordRequestedRange(1, 4, uint16(n), 1)
+	}
+	if len(requested) != maxRequestedRanges {
+		t.Errorf("expected %d ranges to be kept, got %d", maxRequestedRanges, len(requested))
+	}
+	if _, ck := requested[pollKey{unit: 1, function: 4, start: maxRequestedRanges + 9, count: 1}]; !ck {
+		t.Error("expected the most recent range to be kept")
+	}
+}
+
+func TestLearnedRangeOffset(t *testing.T) {
+	// A DDSU666 whose registers from 0x2000 are held from 40001.
+	cfg := configData{Clients: []rtuData{{Devices: []remoteDevice{
+		{ID: 3, Ranges: []regRange{{Start: 48193, Finish: 48209, Offset: 8192}, {Start: 30001, Finish: 30003}}},
+		{ID: 4, Ranges: []regRange{{Start: 48193, Finish: 48209, Offset: 8192}, {Start: 416385, Finish: 416397, Offset: 16352}}},
+	}}}}
+	key := pollKey{unit: 3, function: 3, start: 20, count: 4}
+	offset, err := learnedOffset(cfg, key.unit, key.function)
+	if err != nil || offset != 8192 {
+		t.Fatalf("expected offset 8192, got %d (%v)", offset, err)
+	}
+	rng, err := learnedRange(key, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (regRange{Start: 48213, Finish: 48217, Delay: int(defaultDelay), Offset: 8192}); rng != want {
+		t.Errorf("expected %v, got %v", want, rng)
+	}
+	if rng, _ := learnedRange(pollKey{unit: 3, function: 3, start: 40, count: 2}, 16352); rng.Start != 416393 || rng.Finish != 416395 {
+		t.Errorf("expected registers beyond 9999 to be numbered with an extra digit, got %v", rng)
+	}
+	mergeLearnedRanges(&cfg, []remoteDevice{{ID: 3, Ranges: []regRange{rng}}})
+	if !rangePolled(cfg, key) {
+		t.Error("expected the learned range to cover the registers read")
+	}
+
+	if offset, _ := learnedOffset(cfg, 3, 4); offset != 0 {
+		t.Errorf("expected no offset for the input registers, got %d", offset)
+	}
+	if _, err := learnedOffset(cfg, 4, 3); err == nil {
+		t.Error("expected an error for a device polled with different offsets")
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"log/syslog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,29 +18,184 @@ import (
 func main() {
 	var mode string
 	var cfgFn string
+	var captureFn string
+	var check, strict, watch bool
+	var scanPortList, scanBauds, scanParities, scanIDs, scanOut string
+	var dumpDevice int
+	var dumpRegs, dumpMap string
 
 	flag.StringVar(&mode, "mode", "", "Mode to start in. Used for testing/development")
 	flag.StringVar(&cfgFn, "cfg", "configuration.yaml", "Configuration file (default configuration.yaml)")
+	flag.StringVar(&captureFn, "capture", "", "Capture file to replay when using -mode replay")
+	flag.BoolVar(&check, "check", false, "Validate the configuration file and exit")
+	flag.BoolVar(&strict, "strict", false, "Reject unknown keys in the configuration file")
+	flag.BoolVar(&watch, "watch", false, "Reload the configuration file when it changes")
+
+	flag.StringVar(&scanPortList, "ports", "", "Serial ports to scan when using -mode scan, or the port for -mode dump and sniff (default from the configuration)")
+	flag.StringVar(&scanBauds, "bauds", defaultScanBauds, "Baud rates to scan when using -mode scan. The first is used by -mode dump and sniff")
+	flag.StringVar(&scanParities, "parities", defaultScanParities, "Parities to scan when using -mode scan. The first is used by -mode dump and sniff")
+	flag.StringVar(&scanIDs, "ids", defaultScanIDs, "Unit IDs to scan when using -mode scan")
+	flag.StringVar(&scanOut, "out", "", "File for the starter configuration from -mode scan or sniff (default stdout)")
+	flag.IntVar(&dumpDevice, "device", int(defaultServerDevice), "Device to read when using -mode dump")
+	flag.StringVar(&dumpRegs, "registers", "", "Registers to read when using -mode dump, e.g. 30001-30020")
+	flag.StringVar(&dumpMap, "map", "", "Register map (a list of fields) to apply when using -mode dump")
 
 	flag.Parse()
 
+	if check {
+		if !checkConfiguration(cfgFn, strict) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if mode == "scan" {
+		opts := scanOptions{parities: strings.Split(scanParities, ","), timeout: defaultScanTimeout}
+		var err error
+		if opts.bauds, err = parseIntList(scanBauds); err != nil {
+			log.Fatal(err)
+		}
+		if opts.ids, err = parseIDList(scanIDs); err != nil {
+			log.Fatal(err)
+		}
+		if scanPortList != "" {
+			opts.ports = strings.Split(scanPortList, ",")
+		} else {
+			opts.ports = scanPorts(cfgFn)
+		}
+		out := os.Stdout
+		if scanOut != "" {
+			if out, err = os.Create(scanOut); err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		if err := runScan(opts, out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if mode == "sniff" {
+		port := rtuData{Devicename: strings.Split(scanPortList, ",")[0], Parity: strings.Split(scanParities, ",")[0]}
+		var err error
+		if port.Baudrate, err = strconv.Atoi(strings.Split(scanBauds, ",")[0]); err != nil {
+			log.Fatal(err)
+		}
+		if port.Devicename == "" {
+			// Default to the bus the server will be connected to.
+			cfg, _, _ := loadConfiguration(cfgFn, false)
+			resolveUSBDevices(&cfg)
+			for _, sd := range cfg.serverPorts() {
+				if sd.TCP == "" {
+					port = sd.rtuData
+					break
+				}
+			}
+		}
+		out := os.Stdout
+		if scanOut != "" {
+			if out, err = os.Create(scanOut); err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		quit := make(chan bool, 1)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			quit <- true
+		}()
+		if err := runSniffer(port, os.Stdout, out, quit); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if mode == "dump" {
+		opts := dumpOptions{id: byte(dumpDevice)}
+		var err error
+		if opts.rng, err = parseRegisterList(dumpRegs); err != nil {
+			log.Fatal(err)
+		}
+		// The configuration is optional, but gives the port settings and fields.
+		cfg, _, _ := loadConfiguration(cfgFn, false)
+		resolveUSBDevices(&cfg)
+		port, dev, ck := dumpPort(cfg, opts.id)
+		exposed := opts.id
+		if ck {
+			exposed = dev.exposedID()
+		}
+		if scanPortList != "" || !ck {
+			port = rtuData{Devicename: strings.Split(scanPortList, ",")[0],
+				Parity: strings.Split(scanParities, ",")[0]}
+			if port.Baudrate, err = strconv.Atoi(strings.Split(scanBauds, ",")[0]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		opts.port = port
+		if dumpMap != "" {
+			if opts.fields, err = loadRegisterMap(dumpMap); err != nil {
+				log.Fatal(err)
+			}
+		} else if cfg.Source.DeviceID == exposed {
+			opts.fields = cfg.Source.Fields
+		}
+		if err := dumpRegisters(opts, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	fmt.Printf("Meter Proxy. Reading configuration from %s\n", cfgFn)
 
-        if err := parseConfiguration(cfgFn); err != nil {                           
-                log.Fatal(err)                                                      
-        } 
+	if err := parseConfiguration(cfgFn, strict); err != nil {
+		log.Fatal(err)
+	}
+
+	if mode == "replay" {
+		ok, err := runReplay(captureFn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if mode == "simulate" {
+		quit := make(chan bool)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			quit <- true
+		}()
+		if err := runSimulator(appConfig.Simulator, quit); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	findUSBSerialDevices()
 	if len(usbSerialDevices) == 0 {
 		fmt.Println("Unable to find any suitable USB devices? Exiting...")
 		os.Exit(1)
 	}
+	hotplug.scan(scanUSBSerialAdapters(usbSysfsPath))
+	go hotplug.run(usbSysfsPath, hotplugInterval)
 
 	logwriter, e := syslog.New(syslog.LOG_DEBUG|syslog.LOG_DAEMON, "meterproxy")
 	if e == nil {
 		log.SetOutput(logwriter)
 	}
 
+	if err := startCapture(); err != nil {
+		log.Fatal(err)
+	}
+
 	quitChannel := make(chan bool)
 	// Start client to collect data before we start serving responses.
 	if mode == "" || mode == "client" {
@@ -53,10 +210,16 @@ func main() {
 	}
 
 	if mode == "" || mode == "server" {
-		if err := startServer(quitChannel); err != nil {
+		if err := startServer(); err != nil {
 			log.Fatal(err)
 		}
-		addStandardDevice(1)
+		addStandardDevice(defaultServerDevice)
+		addVirtualDevices(appConfig)
+		go runLearner()
+	}
+
+	if err := startHTTPServer(); err != nil {
+		log.Fatal(err)
 	}
 
 	if mode == "" {
@@ -74,6 +237,28 @@ func main() {
 		quitChannel <- true
 	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Print("SIGHUP received, reloading configuration")
+			if err := reloadConfiguration(cfgFn, strict); err != nil {
+				log.Printf("Reload: ignoring invalid configuration: %v", err)
+			}
+		}
+	}()
+	if watch {
+		go watchConfiguration(cfgFn, strict, 5*time.Second)
+	}
+
+	toggle := make(chan os.Signal, 1)
+	signal.Notify(toggle, syscall.SIGUSR1)
+	go func() {
+		for range toggle {
+			setCaptureEnabled(!captureEnabled())
+		}
+	}()
+
 	if mode == "client" {
 		fmt.Println("Started as client. Will run until CTRL+C used.")
 	}
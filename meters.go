@@ -0,0 +1,158 @@
+package main
+
+/* Meter layouts.
+ * A layout describes the registers of a meter model, naming each value and the phase it
+ * belongs to, so values can be matched up between meters of different models. Layouts
+ * for supported meters are bundled from the meters directory, and others can be loaded
+ * from the files listed in the configuration.
+ *
+ * A value is held as register value * scale, e.g. a scale of 0.1 for a meter holding
+ * tenths of a volt. The totals of a single phase meter are its phase 1 values.
+ */
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type meterField struct {
+	Name      string
+	Phase     int
+	Register  int
+	Type      string
+	Scale     float64
+	Units     string
+	Aggregate string
+	// For ratio fields, the names of the fields divided.
+	Numerator, Denominator string
+}
+
+type meterLayout struct {
+	Name        string
+	Description string
+	Phases      int
+	Fields      []meterField
+}
+
+//go:embed meters/*.yaml
+var bundledMeters embed.FS
+
+func parseMeterLayout(data []byte) (*meterLayout, error) {
+	var ml meterLayout
+	if err := yaml.Unmarshal(data, &ml); err != nil {
+		return nil, err
+	}
+	if ml.Name == "" {
+		return nil, fmt.Errorf("layout has no name")
+	}
+	for _, fld := range ml.Fields {
+		if !validValueType(fld.Type) {
+			return nil, fmt.Errorf("%s: unknown value type %q", fld.Name, fld.Type)
+		}
+		typ, reg, err := parseRegister(fld.Register)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%s: %v", fld.Name, err)
+		case typ != 3 && typ != 4:
+			return nil, fmt.Errorf("%s: register %d is not an input (3xxxx) or holding (4xxxx) register", fld.Name, fld.Register)
+		case int(reg)+registerSize(fld.Type) > len(registerData{}):
+			return nil, fmt.Errorf("%s: register %d is beyond the %d registers held for each device", fld.Name, fld.Register, len(registerData{}))
+		}
+		switch fld.Aggregate {
+		case "", "sum", "average":
+		case "ratio":
+			if fld.Numerator == "" || fld.Denominator == "" {
+				return nil, fmt.Errorf("%s: a ratio needs a numerator and denominator", fld.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown aggregate %q", fld.Name, fld.Aggregate)
+		}
+	}
+	return &ml, nil
+}
+
+// loadMeterLayouts reads the layouts from the files, by name.
+func loadMeterLayouts(files []string) (map[string]*meterLayout, error) {
+	layouts := make(map[string]*meterLayout)
+	for _, fn := range files {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		ml, err := parseMeterLayout(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		layouts[strings.ToLower(ml.Name)] = ml
+	}
+	return layouts, nil
+}
+
+// meterLayoutNames returns the names of the bundled layouts.
+func meterLayoutNames() []string {
+	entries, _ := bundledMeters.ReadDir("meters")
+	var names []string
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findMeterLayout returns the layout with the name, from those loaded or those bundled.
+func findMeterLayout(layouts map[string]*meterLayout, name string) (*meterLayout, error) {
+	if ml, ck := layouts[strings.ToLower(name)]; ck {
+		return ml, nil
+	}
+	data, err := bundledMeters.ReadFile(path.Join("meters", strings.ToLower(name)+".yaml"))
+	if err != nil {
+		names := meterLayoutNames()
+		for loaded := range layouts {
+			names = append(names, loaded)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown meter layout %q, available: %s", name, strings.Join(names, ", "))
+	}
+	ml, err := parseMeterLayout(data)
+	if err != nil {
+		return nil, fmt.Errorf("meter layout %s: %v", name, err)
+	}
+	return ml, nil
+}
+
+// field returns the field with the name for the phase, where 0 is the whole meter.
+func (ml *meterLayout) field(name string, phase int) (meterField, bool) {
+	for _, fld := range ml.Fields {
+		if fld.Name == name && fld.Phase == phase {
+			return fld, true
+		}
+	}
+	if ml.Phases == 1 && phase == 0 {
+		for _, prefix := range []string{"total_", "average_"} {
+			if single, ok := strings.CutPrefix(name, prefix); ok {
+				return ml.field(single, 1)
+			}
+		}
+	}
+	return meterField{}, false
+}
+
+// scaled returns the expression for the field's value on the device.
+func (fld meterField) scaled(device byte) string {
+	typ := fld.Type
+	if typ == "" {
+		typ = "float32"
+	}
+	ref := fmt.Sprintf("{%d:%d:%s}", device, fld.Register, typ)
+	if fld.Scale == 0 || fld.Scale == 1 {
+		return ref
+	}
+	return ref + " * " + strconv.FormatFloat(fld.Scale, 'f', -1, 64)
+}
@@ -0,0 +1,229 @@
+package main
+
+/* A minimal Prometheus text exposition of the daemon state.
+ * Counters and histograms are updated as events happen, while the meter field values,
+ * collector error counts and MQTT state are sampled from their source when scraped.
+ */
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zathras777/modbusdev"
+)
+
+type metricType string
+
+const (
+	counterMetric   metricType = "counter"
+	gaugeMetric     metricType = "gauge"
+	histogramMetric metricType = "histogram"
+)
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]float64
+	histos map[string]*histogramValue
+}
+
+var (
+	pollLatency = newMetricFamily("meterproxy_poll_duration_seconds",
+		"Time taken to read a register range from an upstream device.", histogramMetric, "bus")
+	serverRequests = newMetricFamily("meterproxy_server_requests_total",
+		"Requests answered by the server, by port, function code and exception code (0 for success).",
+		counterMetric, "port", "function", "exception")
+	serverDenied = newMetricFamily("meterproxy_server_denied_total",
+		"Requests refused by the access policy of a server port, by port, function code and reason.",
+		counterMetric, "port", "function", "reason")
+	serverIgnored = newMetricFamily("meterproxy_server_ignored_total",
+		"Requests not answered by a server port, as they were for another unit or broadcast reads.",
+		counterMetric, "port", "reason")
+	serverFrameErrors = newMetricFamily("meterproxy_server_frame_errors_total",
+		"Frames received by the server that failed the CRC check.", counterMetric, "port")
+)
+
+var defaultBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+func newMetricFamily(name, help string, typ metricType, labels ...string) *metricFamily {
+	mf := &metricFamily{name: name, help: help, typ: typ, labels: labels,
+		values: make(map[string]float64), histos: make(map[string]*histogramValue)}
+	if typ == histogramMetric {
+		mf.buckets = defaultBuckets
+	}
+	return mf
+}
+
+func (mf *metricFamily) key(labelValues []string) string {
+	if len(labelValues) != len(mf.labels) {
+		log.Printf("Metrics: %s expects %d labels, got %d", mf.name, len(mf.labels), len(labelValues))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (mf *metricFamily) inc(labelValues ...string) {
+	mf.add(1, labelValues...)
+}
+
+func (mf *metricFamily) add(v float64, labelValues ...string) {
+	k := mf.key(labelValues)
+	mf.mu.Lock()
+	mf.values[k] += v
+	mf.mu.Unlock()
+}
+
+func (mf *metricFamily) set(v float64, labelValues ...string) {
+	k := mf.key(labelValues)
+	mf.mu.Lock()
+	mf.values[k] = v
+	mf.mu.Unlock()
+}
+
+func (mf *metricFamily) observe(v float64, labelValues ...string) {
+	k := mf.key(labelValues)
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	h, ck := mf.histos[k]
+	if !ck {
+		h = &histogramValue{counts: make([]uint64, len(mf.buckets))}
+		mf.histos[k] = h
+	}
+	for n, b := range mf.buckets {
+		if v <= b {
+			h.counts[n]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (mf *metricFamily) observeDuration(start time.Time, labelValues ...string) {
+	mf.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// labelEscaper escapes a label value as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for n, name := range names {
+		val := ""
+		if n < len(values) {
+			val = values[n]
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(val)))
+	}
+	for n := 0; n+1 < len(extra); n += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[n], labelEscaper.Replace(extra[n+1])))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+func (mf *metricFamily) writeTo(w io.Writer) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mf.name, mf.help, mf.name, mf.typ)
+	if mf.typ == histogramMetric {
+		for _, k := range sortedKeys(mf.histos) {
+			h := mf.histos[k]
+			lv := strings.Split(k, "\xff")
+			for n, b := range mf.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", mf.name, formatLabels(mf.labels, lv, "le", formatFloat(b)), h.counts[n])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", mf.name, formatLabels(mf.labels, lv, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", mf.name, formatLabels(mf.labels, lv), formatFloat(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", mf.name, formatLabels(mf.labels, lv), h.count)
+		}
+		return
+	}
+	for _, k := range sortedKeys(mf.values) {
+		fmt.Fprintf(w, "%s%s %s\n", mf.name, formatLabels(mf.labels, strings.Split(k, "\xff")), formatFloat(mf.values[k]))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sampledMetrics builds the families whose values are read from their source at scrape time.
+func sampledMetrics() []*metricFamily {
+	cfg := currentConfig()
+	fields := newMetricFamily("meterproxy_field_value",
+		"Current value of a recorded meter field.", gaugeMetric, "meter", "field", "units")
+	regA, err := getRegisterAccess(cfg.Source.DeviceID, 4)
+	if err == modbusSuccess {
+		var v modbusdev.Value
+		for _, fld := range cfg.Source.Fields {
+			data, err := regA.Read(fld.Idx, 2)
+			if err != modbusSuccess {
+				continue
+			}
+			v.FormatBytes("ieee32", data[1:])
+			fields.set(float64(v.Ieee32), cfg.Name, fld.Name, fld.Units)
+		}
+	}
+
+	actionErrors := newMetricFamily("meterproxy_collector_errors_total",
+		"Failed reads of a register range from an upstream device.", counterMetric, "bus", "device", "action")
+	for _, bus := range currentBusses() {
+		for _, dev := range bus.devices {
+			for _, act := range dev.actions {
+				actionErrors.set(float64(act.failureCount()), bus.name, fmt.Sprintf("%d", dev.exposed), act.String())
+			}
+		}
+	}
+
+	mqttState := newMetricFamily("meterproxy_mqtt_connected",
+		"Whether the MQTT client is currently connected (1) or not (0).", gaugeMetric)
+	connected := 0.0
+	if client := currentMQTTClient(); client != nil && client.IsConnected() {
+		connected = 1
+	}
+	mqttState.set(connected)
+
+	return []*metricFamily{fields, actionErrors, mqttState}
+}
+
+func writeMetrics(w io.Writer) {
+	for _, mf := range sampledMetrics() {
+		mf.writeTo(w)
+	}
+	for _, mf := range []*metricFamily{pollLatency, serverRequests, serverDenied, serverIgnored, serverFrameErrors} {
+		mf.writeTo(w)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricFamilyHistogramExposition(t *testing.T) {
+	mf := newMetricFamily("test_seconds", "Test histogram.", histogramMetric, "bus")
+	mf.observe(0.02, "/dev/ttyUSB1")
+	mf.observe(3, "/dev/ttyUSB1")
+
+	var buf bytes.Buffer
+	mf.writeTo(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{bus="/dev/ttyUSB1",le="0.01"} 0`,
+		`test_seconds_bucket{bus="/dev/ttyUSB1",le="0.025"} 1`,
+		`test_seconds_bucket{bus="/dev/ttyUSB1",le="+Inf"} 2`,
+		`test_seconds_count{bus="/dev/ttyUSB1"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected output to contain %s, got\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteMetricsIncludesFieldValues(t *testing.T) {
+	regA := setupTestEnvironment(t)
+	writeFloatToRegister(t, regA, 230.5)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	want := `meterproxy_field_value{meter="TestDevice",field="Power",units="W"} 230.5`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected output to contain %s, got\n%s", want, buf.String())
+	}
+	if !strings.Contains(buf.String(), "meterproxy_mqtt_connected 0") {
+		t.Fatalf("expected disconnected MQTT state, got\n%s", buf.String())
+	}
+}
+
+func TestMetricLabelEscaping(t *testing.T) {
+	mf := newMetricFamily("test_total", "Test counter.", counterMetric, "action")
+	mf.set(1, "a \"b\" \\c\nd é")
+
+	var buf bytes.Buffer
+	mf.writeTo(&buf)
+	if want := `test_total{action="a \"b\" \\c\nd é"} 1`; !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected output to contain %s, got\n%s", want, buf.String())
+	}
+}
+
+func TestCollectorErrorsNeverReset(t *testing.T) {
+	setupTestEnvironment(t)
+	act := &deviceAction{opType: 3, startRegister: 0, finishRegister: 4, numRegs: 4}
+	bussesMu.Lock()
+	deviceBusses = []deviceBus{{name: "test", devices: []device{{id: 1, exposed: 1, actions: []*deviceAction{act}}}}}
+	bussesMu.Unlock()
+	t.Cleanup(func() {
+		bussesMu.Lock()
+		deviceBusses = nil
+		bussesMu.Unlock()
+	})
+
+	act.failed(gatewayTargetFailed)
+	act.failed(gatewayTargetFailed)
+	act.resetErrors()
+	act.succeeded()
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	want := `meterproxy_collector_errors_total{bus="test",device="1",action="ReadInputRegisters from 0 to 4"} 2`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected output to contain %s, got\n%s", want, buf.String())
+	}
+}
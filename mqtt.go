@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -11,20 +13,41 @@ import (
 )
 
 var (
-	val        modbusdev.Value
-	mqttClient mqtt.Client
+	val modbusdev.Value
+
+	// The client is replaced by the recording loop, and read by the HTTP handlers.
+	mqttClient   mqtt.Client
+	mqttClientMu sync.RWMutex
+
+	// Set by a configuration reload to have the recording loop reconnect and/or
+	// republish the HA discovery information.
+	mqttReconnect atomic.Bool
+	haRefresh     atomic.Bool
 )
 
+func currentMQTTClient() mqtt.Client {
+	mqttClientMu.RLock()
+	defer mqttClientMu.RUnlock()
+	return mqttClient
+}
+
+func setMQTTClient(client mqtt.Client) {
+	mqttClientMu.Lock()
+	mqttClient = client
+	mqttClientMu.Unlock()
+}
+
 // Execute Execute the stored query using supplied map of values
 func execute() (err error) {
-	regA, err := getRegisterAccess(appConfig.Source.DeviceID, 4)
+	cfg := currentConfig()
+	regA, err := getRegisterAccess(cfg.Source.DeviceID, 4)
 	if err != modbusSuccess {
 		log.Printf("Error getting registerAccess: %s", err)
 		return
 	}
 
-	client := mqttClient
-	for _, fld := range appConfig.Source.Fields {
+	client := currentMQTTClient()
+	for _, fld := range cfg.Source.Fields {
 		data, err := regA.Read(fld.Idx, 2)
 		if err != modbusSuccess {
 			log.Printf("Unable to access index %d: %s", fld.Idx, err)
@@ -34,15 +57,21 @@ func execute() (err error) {
 			continue
 		}
 		val.FormatBytes("ieee32", data[1:])
-		token := client.Publish(fld.topic, appConfig.MQTT.QoS, true, fmt.Sprintf("%.02f", val.Ieee32))
+		token := client.Publish(fld.topic, cfg.MQTT.QoS, true, fmt.Sprintf("%.02f", val.Ieee32))
 		token.Wait()
 	}
 	return nil
 }
 
-func startRecording() {
+func newMQTTOptions(cfg configData) *mqtt.ClientOptions {
 	mqOpts := mqtt.NewClientOptions()
-	mqOpts.AddBroker(fmt.Sprintf("tcp://%s:%d", appConfig.MQTT.Host, appConfig.MQTT.Port))
+	mqOpts.AddBroker(fmt.Sprintf("tcp://%s:%d", cfg.MQTT.Host, cfg.MQTT.Port))
+	return mqOpts
+}
+
+func startRecording() {
+	cfg := currentConfig()
+	mqOpts := newMQTTOptions(cfg)
 
 	const retryDelay = 5 * time.Second
 	var (
@@ -51,26 +80,40 @@ func startRecording() {
 	)
 
 	for {
-		if mqttClient == nil {
-			mqttClient = mqtt.NewClient(mqOpts)
+		client := currentMQTTClient()
+		if mqttReconnect.Swap(false) {
+			if client != nil && client.IsConnected() {
+				client.Disconnect(250)
+			}
+			cfg = currentConfig()
+			mqOpts = newMQTTOptions(cfg)
+			client = nil
+		}
+		if haRefresh.Swap(false) {
+			registeredHA = false
+		}
+
+		if client == nil {
+			client = mqtt.NewClient(mqOpts)
+			setMQTTClient(client)
 			registeredHA = false
 			nextConnectAttempt = time.Time{}
 		}
 
-		if !mqttClient.IsConnected() && time.Now().After(nextConnectAttempt) {
-			token := mqttClient.Connect()
+		if !client.IsConnected() && time.Now().After(nextConnectAttempt) {
+			token := client.Connect()
 			if token.Wait() && token.Error() != nil {
 				log.Printf("Unable to connect to the MQTT server at %s:%d: %v. Retrying in %s",
-					appConfig.MQTT.Host, appConfig.MQTT.Port, token.Error(), retryDelay)
+					cfg.MQTT.Host, cfg.MQTT.Port, token.Error(), retryDelay)
 				nextConnectAttempt = time.Now().Add(retryDelay)
 			} else {
 				log.Printf("Connected to the MQTT server at %s:%d",
-					appConfig.MQTT.Host, appConfig.MQTT.Port)
+					cfg.MQTT.Host, cfg.MQTT.Port)
 				registeredHA = false
 			}
 		}
 
-		if mqttClient.IsConnected() && !registeredHA {
+		if client.IsConnected() && !registeredHA {
 			registerHA()
 			registeredHA = true
 		}
@@ -83,7 +126,8 @@ func startRecording() {
 }
 
 func registerHA() {
-	client := mqttClient
+	cfg := currentConfig()
+	client := currentMQTTClient()
 	if client == nil || !client.IsConnected() {
 		return
 	}
@@ -94,9 +138,9 @@ func registerHA() {
 		StateTopic        string `json:"state_topic"`
 		UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
 	}
-	for _, fld := range appConfig.Source.Fields {
+	for _, fld := range cfg.Source.Fields {
 		haData := hassAdvert{
-			Name:              fmt.Sprintf("%s %s", appConfig.Name, fld.Name),
+			Name:              fmt.Sprintf("%s %s", cfg.Name, fld.Name),
 			StateTopic:        fld.topic,
 			UniqueID:          fld.uid,
 			UnitOfMeasurement: fld.Units}
@@ -109,7 +153,21 @@ func registerHA() {
 			log.Printf("Unable to encode HA json: %s", err)
 			continue
 		}
-		client.Publish(fmt.Sprintf("%s/sensor/%s/%d/config", appConfig.MQTT.HassdiscoveryPrefix,
-			appConfig.Name, fld.Idx), appConfig.MQTT.QoS, true, jsonBytes)
+		client.Publish(haConfigTopic(cfg, fld), cfg.MQTT.QoS, true, jsonBytes)
+	}
+}
+
+func haConfigTopic(cfg configData, fld recordField) string {
+	return fmt.Sprintf("%s/sensor/%s/%d/config", cfg.MQTT.HassdiscoveryPrefix, cfg.Name, fld.Idx)
+}
+
+// unregisterHA removes the discovery information for fields that are no longer recorded.
+func unregisterHA(cfg configData, fields []recordField) {
+	client := currentMQTTClient()
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	for _, fld := range fields {
+		client.Publish(haConfigTopic(cfg, fld), cfg.MQTT.QoS, true, []byte{})
 	}
 }
@@ -143,8 +143,8 @@ func TestExecutePublishesWhenConnected(t *testing.T) {
 	writeFloatToRegister(t, regA, 12.34)
 
 	client := &fakeClient{connected: true}
-	mqttClient = client
-	t.Cleanup(func() { mqttClient = nil })
+	setMQTTClient(client)
+	t.Cleanup(func() { setMQTTClient(nil) })
 
 	if err := execute(); err != nil {
 		t.Fatalf("execute returned error: %v", err)
@@ -173,8 +173,8 @@ func TestExecuteSkipsWhenClientDisconnected(t *testing.T) {
 	writeFloatToRegister(t, regA, 45.67)
 
 	client := &fakeClient{connected: false}
-	mqttClient = client
-	t.Cleanup(func() { mqttClient = nil })
+	setMQTTClient(client)
+	t.Cleanup(func() { setMQTTClient(nil) })
 
 	if err := execute(); err != nil {
 		t.Fatalf("execute returned error: %v", err)
@@ -189,8 +189,8 @@ func TestRegisterHAPublishesOnlyWhenConnected(t *testing.T) {
 	setupTestEnvironment(t)
 
 	client := &fakeClient{connected: false}
-	mqttClient = client
-	t.Cleanup(func() { mqttClient = nil })
+	setMQTTClient(client)
+	t.Cleanup(func() { setMQTTClient(nil) })
 
 	registerHA()
 	if len(client.publishes) != 0 {
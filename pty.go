@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// openPty creates a pseudo-terminal in raw mode, returning the controlling side and the
+// name of the terminal that a client should open. The terminal side is left open so that
+// reads do not fail while no client has it open.
+func openPty() (*os.File, string, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := makeRaw(tty); err != nil {
+		ptmx.Close()
+		tty.Close()
+		return nil, "", err
+	}
+	return ptmx, tty.Name(), nil
+}
+
+func makeRaw(fh *os.File) error {
+	termios, err := unix.IoctlGetTermios(int(fh.Fd()), unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(int(fh.Fd()), unix.TCSETS, termios)
+}
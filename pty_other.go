@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func openPty() (*os.File, string, error) {
+	return nil, "", fmt.Errorf("pseudo-terminals are only supported on linux")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
 )
 
@@ -28,7 +29,10 @@ var standardRegisters = map[byte]registerAccess{
 	4: {reader: readRegisters, writer: writeRegisters},
 }
 
-var devices = make(map[byte]map[byte]*registerAccess)
+var (
+	devices   = make(map[byte]map[byte]*registerAccess)
+	devicesMu sync.RWMutex
+)
 
 func makeRegisterAccess(reader registerReader, writer registerWriter) *registerAccess {
 	reg := register{}
@@ -37,6 +41,8 @@ func makeRegisterAccess(reader registerReader, writer registerWriter) *registerA
 }
 
 func addStandardDevice(deviceNum byte) error {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
 	_, ck := devices[deviceNum]
 	if ck {
 		return fmt.Errorf("device %d already registered?", deviceNum)
@@ -48,7 +54,30 @@ func addStandardDevice(deviceNum byte) error {
 	return nil
 }
 
+func removeDevice(deviceNum byte) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	if _, ck := devices[deviceNum]; ck {
+		delete(devices, deviceNum)
+		log.Printf("Server: Removed device #%d", deviceNum)
+	}
+}
+
+// deviceIDs returns the registered devices in order.
+func deviceIDs() []byte {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	ids := make([]byte, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
 func getRegisterAccess(deviceNum, function byte) (*registerAccess, modbusError) {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
 	deviceRegisters, ck := devices[deviceNum]
 	if !ck {
 		//		log.Printf("Request for unregistered device #%d", deviceNum)
@@ -76,7 +105,22 @@ func (ra *registerAccess) Write(regStart, numReg int, bytes []byte) modbusError
 	return ra.writer(ra.reg, regStart, numReg, bytes)
 }
 
+// checkRegisters returns the exception for a request for registers outside the table, or
+// for more than can be read in a single response.
+func checkRegisters(reg *register, regStart, numReg int) modbusError {
+	switch {
+	case numReg < 1 || numReg > 125:
+		return illegalDataValue
+	case regStart < 0 || regStart+numReg > len(reg.data):
+		return illegalAddress
+	}
+	return modbusSuccess
+}
+
 func readRegisters(reg *register, regStart, numReg int) ([]byte, modbusError) {
+	if mErr := checkRegisters(reg, regStart, numReg); mErr != modbusSuccess {
+		return nil, mErr
+	}
 	regEnd := regStart + numReg
 	bytes := make([]byte, numReg*2+1)
 	bytes[0] = byte(numReg * 2)
@@ -92,6 +136,12 @@ func readRegisters(reg *register, regStart, numReg int) ([]byte, modbusError) {
 }
 
 func writeRegisters(reg *register, regStart, numReg int, bytes []byte) modbusError {
+	if mErr := checkRegisters(reg, regStart, numReg); mErr != modbusSuccess {
+		return mErr
+	}
+	if len(bytes) < numReg*2 {
+		return illegalDataValue
+	}
 	regEnd := regStart + numReg
 
 	idx := 0
@@ -104,3 +154,11 @@ func writeRegisters(reg *register, regStart, numReg int, bytes []byte) modbusErr
 	reg.rw.Unlock()
 	return modbusSuccess
 }
+
+// Values returns a copy of the complete register table.
+func (ra *registerAccess) Values() (vals registerData) {
+	ra.reg.rw.RLock()
+	vals = ra.reg.data
+	ra.reg.rw.RUnlock()
+	return
+}
@@ -0,0 +1,139 @@
+package main
+
+/* Live configuration reload.
+ * On SIGHUP (or when the file changes, if watching) the configuration is loaded and
+ * validated again. An invalid configuration is logged and ignored. Otherwise the changes
+ * are applied to the running daemon. The server port is never reopened, so the master
+ * is not left without data while the collectors restart.
+ */
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var reloadMu sync.Mutex
+
+func reloadConfiguration(cfgFn string, strict bool) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, issues, err := loadConfiguration(cfgFn, strict)
+	if err != nil {
+		return err
+	}
+	if err := logConfigIssues(cfgFn, issues); err != nil {
+		return err
+	}
+	if err := resolveUSBDevices(&cfg); err != nil {
+		return err
+	}
+	mergeLearnedRanges(&cfg, currentLearnedRanges())
+	applyConfiguration(cfg)
+	log.Printf("Reload: applied configuration from %s", cfgFn)
+	return nil
+}
+
+func applyConfiguration(cfg configData) {
+	configMu.Lock()
+	old := appConfig
+	if !reflect.DeepEqual(old.Server, cfg.Server) || !reflect.DeepEqual(old.Servers, cfg.Servers) {
+		log.Print("Reload: server changes require a restart, continuing to use the current ports")
+		cfg.Server, cfg.Servers = old.Server, old.Servers
+	}
+	if old.HTTP.Listen != cfg.HTTP.Listen || old.HTTP.Dashboard != cfg.HTTP.Dashboard || old.HTTP.API != cfg.HTTP.API {
+		log.Print("Reload: HTTP listen, dashboard and api changes require a restart")
+		cfg.HTTP.Listen, cfg.HTTP.Dashboard, cfg.HTTP.API = old.HTTP.Listen, old.HTTP.Dashboard, old.HTTP.API
+	}
+	enabled := cfg.Capture.Enabled
+	cfg.Capture.Enabled = old.Capture.Enabled
+	if old.Capture != cfg.Capture {
+		log.Print("Reload: capture file changes require a restart")
+		cfg.Capture = old.Capture
+	}
+	cfg.Capture.Enabled = enabled
+	appConfig = cfg
+	configMu.Unlock()
+
+	if cfg.Capture.Enabled != old.Capture.Enabled {
+		setCaptureEnabled(cfg.Capture.Enabled)
+	}
+
+	if !reflect.DeepEqual(old.Clients, cfg.Clients) {
+		restartClients(old, cfg)
+	}
+	addVirtualDevices(cfg)
+
+	if old.MQTT.Host != cfg.MQTT.Host || old.MQTT.Port != cfg.MQTT.Port {
+		mqttReconnect.Store(true)
+	}
+	newTopics := make(map[string]bool)
+	for _, fld := range cfg.Source.Fields {
+		newTopics[haConfigTopic(cfg, fld)] = true
+	}
+	var removed []recordField
+	for _, fld := range old.Source.Fields {
+		if !newTopics[haConfigTopic(old, fld)] {
+			removed = append(removed, fld)
+		}
+	}
+	unregisterHA(old, removed)
+	if old.Name != cfg.Name || old.MQTT != cfg.MQTT || !reflect.DeepEqual(old.Source, cfg.Source) {
+		haRefresh.Store(true)
+	}
+}
+
+// restartClients stops all collectors and starts them again with the new configuration.
+// Devices that are still configured keep their cached registers.
+func restartClients(old, cfg configData) {
+	stopClients()
+
+	keep := map[byte]bool{defaultServerDevice: true}
+	for _, id := range virtualDevices(cfg) {
+		keep[id] = true
+	}
+	for _, client := range cfg.Clients {
+		for _, dev := range client.Devices {
+			keep[dev.exposedID()] = true
+		}
+	}
+	for _, client := range old.Clients {
+		for _, dev := range client.Devices {
+			if !keep[dev.exposedID()] {
+				removeDevice(dev.exposedID())
+			}
+		}
+	}
+
+	for _, client := range cfg.Clients {
+		if err := startClient(client); err != nil {
+			log.Printf("Reload: unable to start client for %s: %v", client.Devicename, err)
+		}
+	}
+}
+
+// watchConfiguration reloads the configuration whenever the file modification time changes.
+func watchConfiguration(cfgFn string, strict bool, interval time.Duration) {
+	modTime := func() time.Time {
+		st, err := os.Stat(cfgFn)
+		if err != nil {
+			return time.Time{}
+		}
+		return st.ModTime()
+	}
+	last := modTime()
+	for range time.Tick(interval) {
+		mt := modTime()
+		if mt.IsZero() || mt.Equal(last) {
+			continue
+		}
+		last = mt
+		log.Printf("Reload: %s has changed", cfgFn)
+		if err := reloadConfiguration(cfgFn, strict); err != nil {
+			log.Printf("Reload: ignoring invalid configuration: %v", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const reloadBaseConfig = `name: Meter
+mqtt:
+  host: localhost
+  port: 1883
+  hassdiscovery_prefix: ha
+source:
+  device_id: 1
+  fields:
+  - name: Active Load
+    units: W
+    idx: 12
+  - name: Power Factor
+    idx: 30
+server:
+  devicename: /dev/ttyUSB0
+`
+
+func writeConfig(t *testing.T, fn, data string) {
+	t.Helper()
+	if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadAppliesFieldChanges(t *testing.T) {
+	setupTestEnvironment(t)
+	fn := filepath.Join(t.TempDir(), "configuration.yaml")
+	writeConfig(t, fn, reloadBaseConfig)
+	if err := parseConfiguration(fn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeClient{connected: true}
+	setMQTTClient(client)
+	t.Cleanup(func() { setMQTTClient(nil) })
+	haRefresh.Store(false)
+
+	updated := strings.Replace(reloadBaseConfig, "  - name: Power Factor\n    idx: 30\n", "", 1)
+	updated = strings.Replace(updated, "/dev/ttyUSB0", "/dev/ttyUSB9", 1)
+	writeConfig(t, fn, updated)
+	if err := reloadConfiguration(fn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(appConfig.Source.Fields) != 1 {
+		t.Fatalf("expected 1 field after reload, got %d", len(appConfig.Source.Fields))
+	}
+	if appConfig.Server.Devicename != "/dev/ttyUSB0" {
+		t.Fatalf("server device should not change on reload, got %s", appConfig.Server.Devicename)
+	}
+	if !haRefresh.Load() {
+		t.Fatal("expected HA discovery to be refreshed")
+	}
+	if len(client.publishes) != 1 || client.publishes[0].topic != "ha/sensor/Meter/30/config" {
+		t.Fatalf("expected removed field to be unregistered, got %+v", client.publishes)
+	}
+}
+
+func TestReloadRejectsInvalidConfiguration(t *testing.T) {
+	setupTestEnvironment(t)
+	fn := filepath.Join(t.TempDir(), "configuration.yaml")
+	writeConfig(t, fn, reloadBaseConfig)
+	if err := parseConfiguration(fn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, fn, reloadBaseConfig+"unknown: true\n")
+	if err := reloadConfiguration(fn, true); err == nil {
+		t.Fatal("expected invalid configuration to be rejected")
+	}
+	if len(appConfig.Source.Fields) != 2 {
+		t.Fatalf("configuration should be unchanged, got %d fields", len(appConfig.Source.Fields))
+	}
+}
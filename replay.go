@@ -0,0 +1,207 @@
+package main
+
+/* Replay of captured traffic.
+ * A capture file (see capture.go) is replayed in order. Upstream transactions are fed to the
+ * collector as if the device had answered them, and requests from the master are written to the
+ * server over an in-memory pipe. Each response from the server is compared with the response
+ * recorded in the capture.
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+type replayMismatch struct {
+	Line     int
+	Request  string
+	Expected string
+	Got      string
+}
+
+type replayResult struct {
+	Requests   int
+	Upstream   int
+	Mismatches []replayMismatch
+}
+
+// replayTransporter answers a single upstream request with the recorded response.
+type replayTransporter struct {
+	response []byte
+}
+
+func (rt *replayTransporter) Send(aduRequest []byte) ([]byte, error) {
+	if rt.response == nil {
+		return nil, fmt.Errorf("no recorded response for % x", aduRequest)
+	}
+	return rt.response, nil
+}
+
+func loadCapture(fn string) ([]captureRecord, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var recs []captureRecord
+	scanner := bufio.NewScanner(fh)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// replayUpstream performs the recorded transaction on the port through the collector.
+func replayUpstream(port string, request, response []byte) error {
+	if len(request) < 8 {
+		return fmt.Errorf("upstream request too short: % x", request)
+	}
+	act := &deviceAction{startRegister: binary.BigEndian.Uint16(request[2:4]), numRegs: binary.BigEndian.Uint16(request[4:6])}
+	switch request[1] {
+	case 3:
+		act.opType = 4
+	case 4:
+		act.opType = 3
+	default:
+		return fmt.Errorf("unsupported upstream function %d", request[1])
+	}
+	act.finishRegister = act.startRegister + act.numRegs
+
+	handler := modbus.NewRTUClientHandler("replay")
+	handler.SlaveId = request[0]
+	dev := device{id: request[0], exposed: exposedDeviceID(appConfig, port, request[0]), client: modbus.NewClient2(handler, &replayTransporter{response: response})}
+	bus := deviceBus{name: "replay", devices: []device{dev}}
+	bus.poll(dev, act)
+	if act.errorCount() > 0 {
+		return fmt.Errorf("collector failed to process % x", response)
+	}
+	return nil
+}
+
+// replayServerPort serves the configured server port over an in-memory pipe, returning
+// the port and the master's end of the pipe. The port stops once the pipe is closed.
+func replayServerPort(name string) (*serverPort, net.Conn, error) {
+	for _, sd := range appConfig.serverPorts() {
+		if sd.name() != name {
+			continue
+		}
+		master, slave := net.Pipe()
+		sp := newServerPort(sd)
+		go func() {
+			sp.acceptSerialRequests(slave)
+			sp.close()
+		}()
+		return sp, master, nil
+	}
+	return nil, nil, fmt.Errorf("server port %s is not configured", name)
+}
+
+func replayCapture(recs []captureRecord) (*replayResult, error) {
+	// Each server port in the capture is replayed on a port of its own, with its settings.
+	masters := make(map[string]net.Conn)
+	var ports []*serverPort
+	defer func() {
+		for _, master := range masters {
+			master.Close()
+		}
+		for _, sp := range ports {
+			<-sp.done
+		}
+	}()
+
+	res := &replayResult{}
+	var pending []byte
+	buf := make([]byte, 512)
+	for n, rec := range recs {
+		frame, err := hex.DecodeString(rec.Frame)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", n+1, err)
+		}
+		switch rec.Direction {
+		case clientTx:
+			pending = frame
+		case clientRx:
+			if pending == nil {
+				continue
+			}
+			if err := replayUpstream(rec.Port, pending, frame); err != nil {
+				return nil, fmt.Errorf("record %d: %v", n+1, err)
+			}
+			pending = nil
+			res.Upstream++
+		case serverRx:
+			master, ck := masters[rec.Port]
+			if !ck {
+				var sp *serverPort
+				if sp, master, err = replayServerPort(rec.Port); err != nil {
+					return nil, fmt.Errorf("record %d: %v", n+1, err)
+				}
+				masters[rec.Port] = master
+				ports = append(ports, sp)
+			}
+			res.Requests++
+			if _, err := master.Write(frame); err != nil {
+				return nil, fmt.Errorf("record %d: %v", n+1, err)
+			}
+			master.SetReadDeadline(time.Now().Add(time.Second))
+			got, err := master.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				got = 0
+			} else if err != nil {
+				return nil, fmt.Errorf("record %d: %v", n+1, err)
+			}
+			expected := ""
+			if n+1 < len(recs) && recs[n+1].Direction == serverTx {
+				expected = recs[n+1].Frame
+			}
+			if gotHex := hex.EncodeToString(buf[:got]); gotHex != expected {
+				res.Mismatches = append(res.Mismatches, replayMismatch{Line: n + 1, Request: rec.Frame,
+					Expected: expected, Got: gotHex})
+			}
+		}
+	}
+	return res, nil
+}
+
+// runReplay replays the capture file against the devices in the configuration and reports
+// any differences. Returns false if the server responses did not match.
+func runReplay(fn string) (bool, error) {
+	recs, err := loadCapture(fn)
+	if err != nil {
+		return false, err
+	}
+	for _, client := range appConfig.Clients {
+		for _, dev := range client.Devices {
+			addStandardDevice(dev.exposedID())
+		}
+	}
+	addStandardDevice(defaultServerDevice)
+
+	res, err := replayCapture(recs)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("Replayed %d upstream transactions and %d server requests\n", res.Upstream, res.Requests)
+	for _, mm := range res.Mismatches {
+		fmt.Printf("Line %d: request %s\n  expected %s\n  got      %s\n", mm.Line, mm.Request, mm.Expected, mm.Got)
+	}
+	return len(res.Mismatches) == 0, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupReplay(t *testing.T, fn string) []captureRecord {
+	t.Helper()
+	devices = make(map[byte]map[byte]*registerAccess)
+	appConfig = configData{Server: serverData{rtuData: rtuData{Devicename: "/dev/ttyUSB0"}}}
+	if err := addStandardDevice(1); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := loadCapture(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestReplayBasicCapture(t *testing.T) {
+	recs := setupReplay(t, "testdata/replay_basic.jsonl")
+
+	res, err := replayCapture(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Upstream != 2 || res.Requests != 3 {
+		t.Fatalf("unexpected counts: %d upstream, %d requests", res.Upstream, res.Requests)
+	}
+	for _, mm := range res.Mismatches {
+		t.Errorf("line %d: expected %s got %s", mm.Line, mm.Expected, mm.Got)
+	}
+}
+
+func TestReplayReportsMismatch(t *testing.T) {
+	recs := setupReplay(t, "testdata/replay_basic.jsonl")
+	// Drop the second meter update, so the server should still answer with the first value.
+	recs = append(recs[:4], recs[6:]...)
+
+	res, err := replayCapture(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Mismatches) != 1 || res.Mismatches[0].Line != 5 {
+		t.Fatalf("expected a single mismatch on line 5, got %+v", res.Mismatches)
+	}
+}
+
+func TestReplayServerPorts(t *testing.T) {
+	recs := setupReplay(t, "testdata/replay_basic.jsonl")
+	appConfig.Servers = []serverData{{rtuData: rtuData{Devicename: "/dev/ttyUSB2"}, Units: []byte{2}}}
+	// The second port only answers unit 2, so the request for unit 1 is not answered.
+	recs = append(recs, captureRecord{Direction: serverRx, Port: "/dev/ttyUSB2", Frame: hex.EncodeToString(withCRC(1, 4, 0, 10, 0, 2))})
+
+	res, err := replayCapture(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Requests != 4 || len(res.Mismatches) != 0 {
+		t.Errorf("expected 4 requests with no mismatches, got %d, %+v", res.Requests, res.Mismatches)
+	}
+
+	recs = append(recs, captureRecord{Direction: serverRx, Port: "/dev/ttyUSB3", Frame: hex.EncodeToString(withCRC(1, 4, 0, 10, 0, 2))})
+	if _, err := replayCapture(recs); err == nil || !strings.Contains(err.Error(), "/dev/ttyUSB3 is not configured") {
+		t.Errorf("expected an error for a port that is not configured, got %v", err)
+	}
+}
+
+func TestReplayStopsServerPort(t *testing.T) {
+	recs := setupReplay(t, "testdata/replay_basic.jsonl")
+	// Each replay waits for its ports to stop, so would hang if they did not.
+	for n := 0; n < 5; n++ {
+		if _, err := replayCapture(recs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sp, master, err := replayServerPort(appConfig.Server.name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.Close()
+	select {
+	case <-sp.done:
+	case <-time.After(time.Second):
+		t.Error("server port still running once its pipe was closed")
+	}
+}
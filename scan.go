@@ -0,0 +1,314 @@
+package main
+
+/* Bus scan.
+ * Used when commissioning a site where the meter's unit ID or serial settings are not
+ * known. Every combination of port, baud rate, parity and unit ID is probed with FC3,
+ * FC4 and FC43. Any reply, including an exception, shows a device is present. The
+ * register ranges each device answers are then found and a starter configuration
+ * written in the same format as the clients section.
+ */
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"gopkg.in/yaml.v3"
+)
+
+type scanOptions struct {
+	ports    []string
+	bauds    []int
+	parities []string
+	ids      []byte
+	timeout  time.Duration
+}
+
+type scanResponder struct {
+	port     string
+	baudrate int
+	parity   string
+	id       byte
+	answers  []string
+	identity map[byte]string
+	ranges   []regRange
+}
+
+const (
+	defaultScanBauds    = "9600,19200,38400,4800,2400"
+	defaultScanParities = "N,E,O"
+	defaultScanIDs      = "1-247"
+	defaultScanTimeout  = 200 * time.Millisecond
+	// Registers are probed in blocks, so ranges are found to this granularity.
+	scanBlockSize = 8
+
+	funcReadDeviceIdentification = 0x2B
+	meiReadDeviceIdentification  = 0x0E
+)
+
+// Names of the basic device identification objects.
+var deviceIdentityNames = map[byte]string{0: "VendorName", 1: "ProductCode", 2: "MajorMinorRevision"}
+
+func (sr scanResponder) String() string {
+	desc := fmt.Sprintf("%s %d %s: unit %d answers %s", sr.port, sr.baudrate, sr.parity, sr.id,
+		strings.Join(sr.answers, ", "))
+	for n := byte(0); n < 3; n++ {
+		if v, ck := sr.identity[n]; ck {
+			desc += fmt.Sprintf(", %s %q", deviceIdentityNames[n], v)
+		}
+	}
+	for _, rng := range sr.ranges {
+		desc += fmt.Sprintf("\n    registers %d-%d", rng.Start, rng.Finish-1)
+	}
+	return desc
+}
+
+// parseIDList parses a list of unit IDs such as "1-10,20".
+func parseIDList(s string) ([]byte, error) {
+	var ids []byte
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unit ID %q", part)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid unit ID %q", part)
+			}
+		}
+		if lo < 1 || hi > maxUnitID || hi < lo {
+			return nil, fmt.Errorf("unit IDs must be between 1 and %d, not %q", maxUnitID, part)
+		}
+		for id := lo; id <= hi; id++ {
+			ids = append(ids, byte(id))
+		}
+	}
+	return ids, nil
+}
+
+func parseIntList(s string) ([]int, error) {
+	var out []int
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", part)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// scanPorts returns the ports to scan when none are given: the configured clients if
+// the configuration can be read, otherwise every USB serial adapter.
+func scanPorts(cfgFn string) []string {
+	var ports []string
+	if cfg, _, err := loadConfiguration(cfgFn, false); err == nil {
+		resolveUSBDevices(&cfg)
+		for _, client := range cfg.Clients {
+			if client.Devicename != "" {
+				ports = append(ports, client.Devicename)
+			}
+		}
+	}
+	if len(ports) > 0 {
+		return ports
+	}
+	for _, ua := range scanUSBSerialAdapters(usbSysfsPath) {
+		ports = append(ports, filepath.Join("/dev", ua.Tty))
+	}
+	return ports
+}
+
+// responded returns true if the device replied, even with an exception.
+func responded(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, ck := err.(*modbus.ModbusError)
+	return ck
+}
+
+// readDeviceIdentification requests the device identification objects of the category
+// (FC43/14), 1 for basic, 2 for regular and 3 for extended objects, continuing until
+// every object has been received.
+func readDeviceIdentification(packager modbus.Packager, transporter modbus.Transporter, category byte) (map[byte]string, error) {
+	objects := make(map[byte]string)
+	next := byte(0)
+	for n := 0; n < 256; n++ {
+		pdu := &modbus.ProtocolDataUnit{FunctionCode: funcReadDeviceIdentification,
+			Data: []byte{meiReadDeviceIdentification, category, next}}
+		adu, err := packager.Encode(pdu)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := transporter.Send(adu)
+		if err != nil {
+			return nil, err
+		}
+		if err = packager.Verify(adu, resp); err != nil {
+			return nil, err
+		}
+		if pdu, err = packager.Decode(resp); err != nil {
+			return nil, err
+		}
+		if pdu.FunctionCode != funcReadDeviceIdentification {
+			code := byte(0)
+			if len(pdu.Data) > 0 {
+				code = pdu.Data[0]
+			}
+			return nil, &modbus.ModbusError{FunctionCode: pdu.FunctionCode, ExceptionCode: code}
+		}
+		more, err := parseDeviceIdentification(pdu.Data, objects)
+		if err != nil {
+			return nil, err
+		}
+		if more == 0 {
+			break
+		}
+		next = more
+	}
+	return objects, nil
+}
+
+// parseDeviceIdentification decodes the objects from a FC43/14 response into objects,
+// returning the next object to request if more follow, or 0.
+func parseDeviceIdentification(data []byte, objects map[byte]string) (byte, error) {
+	if len(data) < 6 || data[0] != meiReadDeviceIdentification {
+		return 0, fmt.Errorf("invalid device identification response: % x", data)
+	}
+	pos := 6
+	for n := 0; n < int(data[5]); n++ {
+		if pos+2 > len(data) || pos+2+int(data[pos+1]) > len(data) {
+			return 0, fmt.Errorf("truncated device identification response: % x", data)
+		}
+		size := int(data[pos+1])
+		objects[data[pos]] = string(data[pos+2 : pos+2+size])
+		pos += 2 + size
+	}
+	if data[3] != 0 {
+		return data[4], nil
+	}
+	return 0, nil
+}
+
+// probeRanges reads each block of registers in the table, returning the ranges that
+// answered in the configuration format. Blocks are merged into ranges no longer than a
+// single read returns, ending before the last register held as the configuration requires.
+func probeRanges(read func(uint16, uint16) ([]byte, error), base int) []regRange {
+	var ranges []regRange
+	for start := 0; start < len(registerData{}); start += scanBlockSize {
+		if _, err := read(uint16(start), scanBlockSize); err != nil {
+			continue
+		}
+		finish := min(start+scanBlockSize, len(registerData{})-1)
+		if n := len(ranges); n > 0 && ranges[n-1].Finish == base+start && base+finish-ranges[n-1].Start <= maxLearnedRegisters {
+			ranges[n-1].Finish = base + finish
+			continue
+		}
+		ranges = append(ranges, regRange{Start: base + start, Finish: base + finish, Delay: 100})
+	}
+	return ranges
+}
+
+// probeDevice checks whether a device answers on the unit ID.
+func probeDevice(packager *modbus.RTUClientHandler, port *rtuPort, client modbus.Client, id byte) (scanResponder, bool) {
+	packager.SlaveId = id
+	sr := scanResponder{id: id}
+	if _, err := client.ReadHoldingRegisters(0, 1); responded(err) {
+		sr.answers = append(sr.answers, "FC3")
+	}
+	if _, err := client.ReadInputRegisters(0, 1); responded(err) {
+		sr.answers = append(sr.answers, "FC4")
+	}
+	identity, err := readDeviceIdentification(packager, port, identBasic)
+	if responded(err) {
+		sr.answers = append(sr.answers, "FC43")
+		sr.identity = identity
+	}
+	if len(sr.answers) == 0 {
+		return sr, false
+	}
+	sr.ranges = append(probeRanges(client.ReadHoldingRegisters, 40001), probeRanges(client.ReadInputRegisters, 30001)...)
+	return sr, true
+}
+
+// scanPort probes every unit ID on the port with the given settings.
+func scanPort(opts scanOptions, port string, baud int, parity string) ([]scanResponder, error) {
+	rp := newRTUPort(rtuData{Devicename: port, Baudrate: baud, Parity: parity}, opts.timeout)
+	if err := rp.Connect(); err != nil {
+		return nil, err
+	}
+	defer rp.Close()
+
+	packager := modbus.NewRTUClientHandler(port)
+	client := modbus.NewClient2(packager, rp)
+	var found []scanResponder
+	for _, id := range opts.ids {
+		sr, ck := probeDevice(packager, rp, client, id)
+		if !ck {
+			continue
+		}
+		sr.port, sr.baudrate, sr.parity = port, baud, parity
+		found = append(found, sr)
+	}
+	return found, nil
+}
+
+// starterConfig groups the responders into clients in the configuration format.
+func starterConfig(found []scanResponder) []rtuData {
+	var clients []rtuData
+	for _, sr := range found {
+		n := len(clients) - 1
+		if n < 0 || clients[n].Devicename != sr.port || clients[n].Baudrate != sr.baudrate || clients[n].Parity != sr.parity {
+			clients = append(clients, rtuData{Devicename: sr.port, Baudrate: sr.baudrate, Parity: sr.parity})
+			n++
+		}
+		clients[n].Devices = append(clients[n].Devices, remoteDevice{ID: sr.id, Ranges: sr.ranges})
+	}
+	return clients
+}
+
+func writeStarterConfig(w io.Writer, clients []rtuData) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(struct{ Clients []rtuData }{clients}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// runScan scans every port and writes a starter configuration for the devices found.
+func runScan(opts scanOptions, out io.Writer) error {
+	if len(opts.ports) == 0 {
+		return fmt.Errorf("no serial ports to scan")
+	}
+	var found []scanResponder
+	for _, port := range opts.ports {
+		for _, baud := range opts.bauds {
+			for _, parity := range opts.parities {
+				fmt.Printf("Scanning %s at %d %s...\n", port, baud, parity)
+				res, err := scanPort(opts, port, baud, parity)
+				if err != nil {
+					log.Printf("Scan: unable to open %s: %v", port, err)
+					continue
+				}
+				for _, sr := range res {
+					fmt.Println(sr)
+				}
+				found = append(found, res...)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no devices found")
+	}
+	fmt.Printf("Found %d device(s)\n", len(found))
+	return writeStarterConfig(out, starterConfig(found))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+func TestParseIDList(t *testing.T) {
+	ids, err := parseIDList("1-3, 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ids) != string([]byte{1, 2, 3, 10}) {
+		t.Errorf("unexpected IDs %v", ids)
+	}
+	for _, bad := range []string{"0", "5-2", "1-248", "x"} {
+		if _, err := parseIDList(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestParseDeviceIdentification(t *testing.T) {
+	data := []byte{meiReadDeviceIdentification, 1, 1, 0, 0, 2, 0, 3, 'A', 'B', 'C', 1, 2, 'E', 'M'}
+	objects := make(map[byte]string)
+	next, err := parseDeviceIdentification(data, objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects[0] != "ABC" || objects[1] != "EM" || next != 0 {
+		t.Errorf("unexpected objects %v, next %d", objects, next)
+	}
+	data[3], data[4] = 0xff, 2
+	if next, _ = parseDeviceIdentification(data, objects); next != 2 {
+		t.Errorf("expected more objects from 2, got %d", next)
+	}
+	if _, err := parseDeviceIdentification(data[:10], objects); err == nil {
+		t.Error("expected an error for a truncated response")
+	}
+}
+
+func TestStarterConfig(t *testing.T) {
+	found := []scanResponder{
+		{port: "/dev/ttyUSB0", baudrate: 9600, parity: "N", id: 1, ranges: []regRange{{Start: 30001, Finish: 30017, Delay: 100}}},
+		{port: "/dev/ttyUSB0", baudrate: 9600, parity: "N", id: 2},
+		{port: "/dev/ttyUSB0", baudrate: 19200, parity: "E", id: 3},
+	}
+	var buf bytes.Buffer
+	if err := writeStarterConfig(&buf, starterConfig(found)); err != nil {
+		t.Fatal(err)
+	}
+	want := `clients:
+  - devicename: /dev/ttyUSB0
+    baudrate: 9600
+    parity: "N"
+    devices:
+      - id: 1
+        ranges:
+          - start: 30001
+            finish: 30017
+            delay: 100
+      - id: 2
+        ranges: []
+  - devicename: /dev/ttyUSB0
+    baudrate: 19200
+    parity: E
+    devices:
+      - id: 3
+        ranges: []
+`
+	if buf.String() != want {
+		t.Errorf("unexpected configuration:\n%s", buf.String())
+	}
+}
+
+// chunkedPort answers each request with the response split into chunks, delivered with
+// a delay between them, as a slow serial line does.
+type chunkedPort struct {
+	respond func(req []byte) []byte
+	chunk   int
+	delay   time.Duration
+	pending []byte
+}
+
+func (cp *chunkedPort) Write(b []byte) (int, error) {
+	cp.pending = cp.respond(b)
+	return len(b), nil
+}
+
+func (cp *chunkedPort) Read(b []byte) (int, error) {
+	if len(cp.pending) == 0 {
+		return 0, serial.ErrTimeout
+	}
+	time.Sleep(cp.delay)
+	n := copy(b[:min(len(b), cp.chunk)], cp.pending)
+	cp.pending = cp.pending[n:]
+	return n, nil
+}
+
+func (cp *chunkedPort) Close() error { return nil }
+
+// identityResponder answers FC43/14 requests with the basic objects.
+func identityResponder(objects ...string) func([]byte) []byte {
+	return func(req []byte) []byte {
+		out := []byte{req[0], req[1], meiReadDeviceIdentification, 1, 1, 0, 0, byte(len(objects))}
+		for n, v := range objects {
+			out = append(append(out, byte(n), byte(len(v))), v...)
+		}
+		return binary.LittleEndian.AppendUint16(out, modbusCRC(out))
+	}
+}
+
+func TestReadDeviceIdentificationInChunks(t *testing.T) {
+	rp := newRTUPort(rtuData{Baudrate: 9600}, 100*time.Millisecond)
+	rp.port = &chunkedPort{respond: identityResponder("Eastron", "SDM630-Modbus", "1.07"), chunk: 5, delay: 20 * time.Millisecond}
+	packager := modbus.NewRTUClientHandler("")
+	packager.SlaveId = 3
+	objects, err := readDeviceIdentification(packager, rp, identBasic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects[0] != "Eastron" || objects[1] != "SDM630-Modbus" || objects[2] != "1.07" {
+		t.Errorf("unexpected objects %v", objects)
+	}
+
+	// A response that stops part way fails, rather than waiting for ever.
+	rp.port = &chunkedPort{respond: func(req []byte) []byte { return identityResponder("Eastron")(req)[:9] }, chunk: 5}
+	if _, err := readDeviceIdentification(packager, rp, identBasic); err == nil {
+		t.Error("expected an incomplete response to fail")
+	}
+}
+
+func TestProbeRangesWholeTable(t *testing.T) {
+	// A meter answering every register held.
+	read := func(start, count uint16) ([]byte, error) {
+		if int(start)+int(count) > len(registerData{}) {
+			return nil, &modbus.ModbusError{FunctionCode: 3, ExceptionCode: 2}
+		}
+		return make([]byte, count*2), nil
+	}
+	ranges := probeRanges(read, 40001)
+	next := 40001
+	for _, rng := range ranges {
+		if rng.Start != next || rng.Finish-rng.Start > maxLearnedRegisters {
+			t.Errorf("unexpected range %v after %d", rng, next)
+		}
+		next = rng.Finish
+	}
+	if next != 40001+len(registerData{})-1 {
+		t.Errorf("expected ranges up to the last register held, got %v", ranges)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("server: {devicename: /dev/ttyUSB0, baudrate: 9600, parity: N}\n")
+	found := []scanResponder{{port: "/dev/ttyUSB1", baudrate: 9600, parity: "N", id: 1, ranges: ranges}}
+	if err := writeStarterConfig(&buf, starterConfig(found)); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, issues, err := loadConfiguration(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range issues {
+		t.Errorf("starter configuration: %s", issue)
+	}
+}
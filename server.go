@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/goburrow/serial"
@@ -17,125 +20,442 @@ type request struct {
 	frame *mbserver.RTUFrame
 }
 
-const rtuMinSz = 8
+type requestLogEntry struct {
+	When      time.Time
+	Port      string
+	Address   byte
+	Function  byte
+	Data      string
+	Exception modbusError
+}
+
+const (
+	rtuMinSz          = 8
+	recentRequestsMax = 50
+
+	// The device always available to the master, even when not polled by a client.
+	defaultServerDevice byte = 1
+)
 
-var requestChan = make(chan *request)
+var (
+	recentRequests []requestLogEntry
+	recentMu       sync.Mutex
+)
+
+// serverPort is a serial port or TCP listener that masters send requests to. Each port
+// handles its requests in turn, from the register cache shared by every port.
+type serverPort struct {
+	cfg      serverData
+	name     string
+	requests chan *request
+	done     chan struct{}
+	diag     portDiagnostics
+}
 
-func startServer(quitChannel chan bool) error {
+func newServerPort(cfg serverData) *serverPort {
+	sp := &serverPort{cfg: cfg, name: cfg.name(), requests: make(chan *request), done: make(chan struct{})}
+	go sp.processRequests()
+	return sp
+}
+
+// close stops processing requests. Must only be called once the port has stopped
+// accepting them.
+func (sp *serverPort) close() {
+	close(sp.requests)
+}
+
+func startServer() error {
+	for _, cfg := range appConfig.serverPorts() {
+		sp := newServerPort(cfg)
+		if cfg.TCP != "" {
+			if err := sp.startTCPServer(); err != nil {
+				return err
+			}
+			continue
+		}
+		port, err := openSerialPort(cfg.rtuData)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", cfg.Devicename, err)
+		}
+		go sp.serveSerialPort(port)
+		log.Printf("Server: Started listening on %s", cfg.Devicename)
+	}
+	return nil
+}
+
+func openSerialPort(cfg rtuData) (serial.Port, error) {
 	rtuConfig := serial.Config{
-		Address:  appConfig.Server.Devicename,
-		BaudRate: appConfig.Server.Baudrate,
+		Address:  cfg.Devicename,
+		BaudRate: cfg.Baudrate,
 		DataBits: 8,
 		StopBits: 1,
-		Parity:   appConfig.Server.Parity,
+		Parity:   cfg.Parity,
 		Timeout:  1 * time.Second,
 	}
+	return serial.Open(&rtuConfig)
+}
+
+// serveSerialPort accepts requests on the port. If the port fails or its adapter is removed,
+// the port is closed and reopened once the adapter is available again.
+func (sp *serverPort) serveSerialPort(port io.ReadWriteCloser) {
+	cfg := sp.cfg.rtuData
+	events := hotplug.subscribe()
+	for {
+		done := make(chan error, 1)
+		go func() { done <- sp.acceptSerialRequests(port) }()
 
-	go processRequest()
+	WaitLoop:
+		for {
+			select {
+			case err := <-done:
+				log.Printf("Server: %s failed: %v", cfg.Devicename, err)
+				break WaitLoop
+			case ev := <-events:
+				if !ev.added && cfg.isAdapter(ev.adapter) {
+					log.Printf("Server: adapter for %s removed, pausing", cfg.Devicename)
+					port.Close()
+					<-done
+					break WaitLoop
+				}
+			}
+		}
+		port.Close()
 
-	port, err := serial.Open(&rtuConfig)
-	if err != nil {
-		return fmt.Errorf("failed to open %s: %v", rtuConfig.Address, err)
+		port = reopenSerialPort(&cfg, events)
+		log.Printf("Server: Resumed listening on %s", cfg.Devicename)
 	}
+}
 
-	go acceptSerialRequests(port, quitChannel)
-	log.Printf("Server: Started listening on %s", appConfig.Server.Devicename)
-	return nil
+// reopenSerialPort waits for the adapter to be added, or retries periodically in case the
+// port is not a USB adapter or the event was missed.
+func reopenSerialPort(cfg *rtuData, events chan hotplugEvent) serial.Port {
+	retry := time.NewTicker(5 * time.Second)
+	defer retry.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if !ev.added || !cfg.isAdapter(ev.adapter) {
+				continue
+			}
+			cfg.Devicename = filepath.Join("/dev", ev.adapter.Tty)
+		case <-retry.C:
+			if cfg.usesUSBSelector() {
+				if err := resolveUSBDevice(cfg, scanUSBSerialAdapters(usbSysfsPath)); err != nil {
+					continue
+				}
+			}
+		}
+		port, err := openSerialPort(*cfg)
+		if err == nil {
+			return port
+		}
+		log.Printf("Server: unable to reopen %s: %v", cfg.Devicename, err)
+	}
 }
 
 type frameBuffer struct {
 	buf bytes.Buffer
 }
 
-func acceptSerialRequests(port serial.Port, quitChannel chan bool) {
+// nextFrame removes the next frame from the buffer, trying it as a response first if
+// one is expected from another device on the bus. Responses are only tried on a shared
+// bus. Returns nil if more bytes are needed, or bad if the start of the buffer is not a
+// valid frame.
+func (fb *frameBuffer) nextFrame(shared, responseFirst bool) (frame []byte, isRequest, bad bool) {
+	order := []bool{true}
+	if shared {
+		order = []bool{true, false}
+		if responseFirst {
+			order = []bool{false, true}
+		}
+	}
+	buf := fb.buf.Bytes()
+	more := false
+	for _, isRequest := range order {
+		size := rtuFrameLength(buf, isRequest)
+		switch {
+		case size < 0 || size > rtuMaxSz:
+		case size == 0 || size > len(buf):
+			more = true
+		case validRTUFrame(buf[:size]):
+			return append([]byte(nil), fb.buf.Next(size)...), isRequest, false
+		}
+	}
+	return nil, false, !more
+}
+
+// acceptSerialRequests reads requests from the port until it fails.
+func (sp *serverPort) acceptSerialRequests(port io.ReadWriteCloser) error {
 	fb := frameBuffer{}
-	tmpBuf := make([]byte, 16)
+	tmpBuf := make([]byte, 64)
+	responseFirst := false
 
 	for {
-		// Read bytes into the buffer until we have enough to start
-		// looking for frames...
 		b, err := port.Read(tmpBuf)
 		if err != nil {
 			if err == serial.ErrTimeout {
+				// The rest of a partial frame is not coming.
+				if fb.buf.Len() > 0 && !sp.cfg.Shared {
+					serverFrameErrors.inc(sp.name)
+					sp.diag.busError()
+				}
+				fb.buf.Reset()
 				continue
 			}
-			log.Printf("Server: %v", err)
-			if err == io.EOF {
-				log.Printf("Exiting listen loop.")
-				quitChannel <- true
-				break
-			}
-			continue
+			return err
 		}
 		if b == 0 {
 			continue
 		}
 		fb.buf.Write(tmpBuf[:b])
 
-		for fb.buf.Len() >= rtuMinSz {
-			frame, err := mbserver.NewRTUFrame(fb.buf.Next(rtuMinSz))
-			if err != nil {
-				log.Printf("bad serial frame error %v\n", err)
-				log.Print(fb.buf.Bytes())
+		for fb.buf.Len() > 0 {
+			raw, isRequest, bad := fb.nextFrame(sp.cfg.Shared, responseFirst)
+			if bad {
+				if sp.cfg.Shared {
+					// Out of step with other traffic on the bus.
+					fb.buf.Next(1)
+					continue
+				}
+				log.Printf("Server: %s: bad serial frame % x", sp.name, fb.buf.Bytes())
+				serverFrameErrors.inc(sp.name)
+				sp.diag.busError()
 				fb.buf.Reset()
+				break
+			}
+			if raw == nil {
+				break
+			}
+			recordFrame(serverRx, sp.name, raw)
+			sp.diag.busMessage()
+			// A request for another device will be followed by its response.
+			responseFirst = isRequest && raw[0] != 0 && !sp.exposes(raw[0])
+			if !isRequest {
 				continue
 			}
-			requestChan <- &request{port, frame}
+			// The CRC has been checked, and some requests are too short for mbserver.NewRTUFrame.
+			frame := &mbserver.RTUFrame{Address: raw[0], Function: raw[1], Data: raw[2 : len(raw)-2]}
+			sp.requests <- &request{port, frame}
 		}
 	}
 }
 
-func processRequest() {
-	for {
-		req := <-requestChan
-		//		log.Printf("Server: RX: %02X %02X %s", req.frame.Address, req.frame.Function, hex.EncodeToString(req.frame.Data))
-
-		var (
-			regA  *registerAccess
-			bytes []byte
-			err   modbusError
-			out   []byte
-		)
-		switch req.frame.Function {
-		case 1, 2, 3, 4:
-			regA, err = getRegisterAccess(req.frame.Address, req.frame.Function)
-		case 6:
-			regA, err = getRegisterAccess(req.frame.Address, 3)
+// processRequests answers the requests received on the port, in turn, closing done once
+// the port is closed.
+func (sp *serverPort) processRequests() {
+	defer close(sp.done)
+	for req := range sp.requests {
+		out := sp.handleRequest(req.frame)
+		if out == nil {
+			continue
 		}
-		if err == modbusSuccess {
-			register := int(binary.BigEndian.Uint16(req.frame.Data[0:2]))
-			numRegs := int(binary.BigEndian.Uint16(req.frame.Data[2:4]))
-			dLen := len(req.frame.Data)
-
-			switch req.frame.Function {
-			case 3, 4:
-				bytes, err = regA.Read(register, numRegs)
-			// Write is untested
-			case 6:
-				err = regA.Write(register, numRegs, req.frame.Data[5:dLen])
-			}
+		recordFrame(serverTx, sp.name, out)
+
+		if _, wErr := req.conn.Write(out); wErr != nil {
+			log.Printf("Server: %s: %v", sp.name, wErr)
 		}
+	}
+}
 
-		if err == modbusSuccess {
-			out = []byte{req.frame.Address, req.frame.Function}
-			out = append(out, bytes...)
-		} else {
-			fn := req.frame.Function | 0x80
-			out = []byte{req.frame.Address, fn}
-			out = append(out, err.code)
+// exposes checks whether the unit is answered on the port.
+func (sp *serverPort) exposes(unit byte) bool {
+	if !sp.cfg.serves(unit) {
+		return false
+	}
+	_, mErr := getRegisterAccess(unit, 3)
+	return mErr != unknownDevice
+}
+
+// ignore counts a request that is not answered, logging the first for each unit unless
+// other devices share the bus.
+func (sp *serverPort) ignore(frame *mbserver.RTUFrame, reason string) {
+	serverIgnored.inc(sp.name, reason)
+	if sp.cfg.Shared {
+		return
+	}
+	msg := fmt.Sprintf("Server: %s not answering unit %d, %s", sp.name, frame.Address, reason)
+	deniedLoggedMu.Lock()
+	defer deniedLoggedMu.Unlock()
+	if !deniedLogged[msg] {
+		deniedLogged[msg] = true
+		log.Print(msg)
+	}
+}
+
+// handleRequest performs the request and returns the response frame, or nil if there
+// is to be no response. Requests for units not exposed on a serial port are ignored, as
+// they may be for another device on the bus, and broadcast writes are performed for every
+// unit exposed but never answered. In listen only mode nothing is answered, and only a
+// restart of communications is performed. A TCP port answers every request.
+func (sp *serverPort) handleRequest(frame *mbserver.RTUFrame) []byte {
+	unit := frame.Address
+	if sp.cfg.TCP != "" && (unit == 0 || unit == 0xff) {
+		unit = sp.tcpServerUnit()
+	} else if unit == 0 {
+		sp.handleBroadcast(frame)
+		return nil
+	}
+	var (
+		data []byte
+		err  modbusError
+	)
+	switch {
+	case unit != 0 && sp.exposes(unit):
+		listenOnly := sp.diag.received(false)
+		if listenOnly && !isDiagnostic(frame, diagRestartCommunications) {
+			sp.diag.unanswered()
+			return nil
+		}
+		data, err = sp.perform(unit, frame)
+		if listenOnly || isDiagnostic(frame, diagForceListenOnly) && err == modbusSuccess {
+			sp.diag.unanswered()
+			serverRequests.inc(sp.name, fmt.Sprintf("%d", frame.Function), fmt.Sprintf("%d", byte(err)))
+			logRecentRequest(sp.name, frame, err)
+			return nil
+		}
+	case sp.cfg.TCP != "":
+		// A TCP master has no other devices to hear from, so expects an answer.
+		err = unknownDevice
+	default:
+		sp.ignore(frame, "unit not exposed")
+		return nil
+	}
+	var out []byte
+	if err == modbusSuccess {
+		out = []byte{frame.Address, frame.Function}
+		out = append(out, data...)
+	} else {
+		fn := frame.Function | 0x80
+		out = []byte{frame.Address, fn}
+		out = append(out, byte(err))
+	}
+	sp.diag.answered(frame.Function, err)
+	serverRequests.inc(sp.name, fmt.Sprintf("%d", frame.Function), fmt.Sprintf("%d", byte(err)))
+	logRecentRequest(sp.name, frame, err)
+	crc := modbusCRC(out)
+
+	oLen := len(out)
+	out = append(out, []byte{0, 0}...)
+	binary.LittleEndian.PutUint16(out[oLen:oLen+2], crc)
+	return out
+}
+
+// tcpServerUnit returns the unit answering requests addressed to a TCP port itself (unit
+// 0 or 255), the port's only unit, or 0 if it has more than one.
+func (sp *serverPort) tcpServerUnit() byte {
+	if len(sp.cfg.Units) == 1 {
+		return sp.cfg.Units[0]
+	}
+	return 0
+}
+
+// handleBroadcast performs a broadcast write for every unit exposed on the port.
+func (sp *serverPort) handleBroadcast(frame *mbserver.RTUFrame) {
+	listenOnly := sp.diag.received(true)
+	sp.diag.unanswered()
+	if listenOnly {
+		return
+	}
+	if !writeFunction(frame.Function) {
+		sp.ignore(frame, "broadcast read")
+		return
+	}
+	units := sp.cfg.Units
+	if len(units) == 0 {
+		units = deviceIDs()
+	}
+	result := modbusSuccess
+	for _, unit := range units {
+		if !sp.exposes(unit) {
+			continue
+		}
+		if _, err := sp.perform(unit, frame); err != modbusSuccess {
+			result = err
 		}
-		crc := modbusCRC(out)
+	}
+	serverRequests.inc(sp.name, fmt.Sprintf("%d", frame.Function), fmt.Sprintf("%d", byte(result)))
+	logRecentRequest(sp.name, frame, result)
+}
+
+// perform carries out the request for the unit, returning the data for the response.
+func (sp *serverPort) perform(unit byte, frame *mbserver.RTUFrame) ([]byte, modbusError) {
+	if err, reason := sp.cfg.Access.check(frame); err != modbusSuccess {
+		logDenied(sp.name, frame, reason)
+		return nil, err
+	}
 
-		//		log.Printf("Server: TX: %02X %02X %s", out[0], out[1], hex.EncodeToString(out[2:]))
+	switch frame.Function {
+	case funcReadDeviceIdentification:
+		return deviceIdentificationResponse(unit, frame.Data)
+	case funcDiagnostics, funcGetCommEventCounter, funcGetCommEventLog:
+		if sp.cfg.TCP != "" {
+			return nil, illegalFunction
+		}
+		return sp.diag.diagnostic(frame)
+	}
 
-		oLen := len(out)
-		out = append(out, []byte{0, 0}...)
-		binary.LittleEndian.PutUint16(out[oLen:oLen+2], crc)
+	var (
+		regA *registerAccess
+		err  modbusError
+	)
+	switch frame.Function {
+	case 3, 4:
+		regA, err = getRegisterAccess(unit, frame.Function)
+	case 6, 16:
+		regA, err = getRegisterAccess(unit, 3)
+	default:
+		err = illegalFunction
+	}
+	if err != modbusSuccess {
+		return nil, err
+	}
+	// Serial framing gives every request its length, but a TCP request can be short.
+	if len(frame.Data) < 4 {
+		return nil, illegalDataValue
+	}
+	register := int(binary.BigEndian.Uint16(frame.Data[0:2]))
+	numRegs := int(binary.BigEndian.Uint16(frame.Data[2:4]))
 
-		_, wErr := req.conn.Write(out)
-		if wErr != nil {
-			log.Print(wErr)
-			break
+	switch frame.Function {
+	case 3, 4:
+		recordRequestedRange(unit, frame.Function, uint16(register), uint16(numRegs))
+		data, err := regA.Read(register, numRegs)
+		if err == modbusSuccess {
+			err = upstreamException(unit, frame.Function, register, numRegs)
+		}
+		if err != modbusSuccess {
+			return nil, err
 		}
+		applyOverrides(currentConfig().Virtual, unit, frame.Function, register, data)
+		return data, modbusSuccess
+	case 6:
+		// The response to a write of a single register echoes the request.
+		return frame.Data[0:4], regA.Write(register, 1, frame.Data[2:4])
+	}
+	if len(frame.Data) < 5 || int(frame.Data[4]) != numRegs*2 || len(frame.Data) < 5+numRegs*2 || numRegs > 123 {
+		return nil, illegalDataValue
+	}
+	return frame.Data[0:4], regA.Write(register, numRegs, frame.Data[5:])
+}
+
+func logRecentRequest(port string, frame *mbserver.RTUFrame, err modbusError) {
+	entry := requestLogEntry{When: time.Now(), Port: port, Address: frame.Address, Function: frame.Function,
+		Data: hex.EncodeToString(frame.Data), Exception: err}
+	recentMu.Lock()
+	recentRequests = append(recentRequests, entry)
+	if len(recentRequests) > recentRequestsMax {
+		recentRequests = recentRequests[len(recentRequests)-recentRequestsMax:]
+	}
+	recentMu.Unlock()
+}
+
+// recentServerRequests returns the most recent requests, newest first.
+func recentServerRequests() []requestLogEntry {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	out := make([]requestLogEntry, len(recentRequests))
+	for n, entry := range recentRequests {
+		out[len(recentRequests)-1-n] = entry
 	}
+	return out
 }
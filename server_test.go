@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+func TestServerPortUnits(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(1)
+	addStandardDevice(2)
+	regA, _ := getRegisterAccess(2, 4)
+	regA.Write(0, 1, []byte{0x12, 0x34})
+
+	sp := &serverPort{cfg: serverData{Units: []byte{2}}, name: "test"}
+	out := sp.handleRequest(&mbserver.RTUFrame{Address: 2, Function: 4, Data: []byte{0, 0, 0, 1}})
+	if want := []byte{2, 4, 2, 0x12, 0x34}; string(out[:len(out)-2]) != string(want) {
+		t.Errorf("expected % x, got % x", want, out)
+	}
+	if out = sp.handleRequest(&mbserver.RTUFrame{Address: 1, Function: 4, Data: []byte{0, 0, 0, 1}}); out != nil {
+		t.Errorf("expected unit 1 to be ignored, got % x", out)
+	}
+	sp = &serverPort{name: "test"}
+	if out = sp.handleRequest(&mbserver.RTUFrame{Address: 9, Function: 4, Data: []byte{0, 0, 0, 1}}); out != nil {
+		t.Errorf("expected unknown unit 9 to be ignored, got % x", out)
+	}
+
+	// A broadcast write is performed for every unit on the port, without a response.
+	if out = sp.handleRequest(&mbserver.RTUFrame{Address: 0, Function: 6, Data: []byte{0, 7, 0xbe, 0xef}}); out != nil {
+		t.Errorf("expected no response to a broadcast, got % x", out)
+	}
+	for _, unit := range []byte{1, 2} {
+		regA, _ := getRegisterAccess(unit, 3)
+		if data, _ := regA.Read(7, 1); data[1] != 0xbe || data[2] != 0xef {
+			t.Errorf("unit %d: broadcast write not performed, got % x", unit, data)
+		}
+	}
+}
+
+func TestSharedBusFraming(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(5)
+	sp := &serverPort{cfg: serverData{Units: []byte{5}, Shared: true}, name: "shared", requests: make(chan *request, 4)}
+
+	// A poll of another meter and its response, which is the length of a request, then
+	// noise and a request for our unit.
+	var bus bytes.Buffer
+	bus.Write(withCRC(7, 3, 0, 0, 0, 1))
+	bus.Write(withCRC(7, 3, 2, 0, 9))
+	bus.Write([]byte{0xff})
+	bus.Write(withCRC(5, 4, 0, 0, 0, 2))
+	if err := sp.acceptSerialRequests(readOnlyPort{&bus}); err != io.EOF {
+		t.Fatal(err)
+	}
+	var got []byte
+	for len(sp.requests) > 0 {
+		got = append(got, (<-sp.requests).frame.Address)
+	}
+	if string(got) != string([]byte{7, 5}) {
+		t.Errorf("expected requests for units 7 and 5, got %v", got)
+	}
+}
+
+// readOnlyPort presents a buffer as a port.
+type readOnlyPort struct {
+	io.Reader
+}
+
+func (readOnlyPort) Write(b []byte) (int, error) { return len(b), nil }
+func (readOnlyPort) Close() error                { return nil }
+
+func TestTCPServerPort(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(3)
+	regA, _ := getRegisterAccess(3, 3)
+	regA.Write(1, 1, []byte{0xab, 0xcd})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sp := newServerPort(serverData{TCP: ln.Addr().String()})
+	go sp.acceptTCPConnections(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 7, 0, 0, 0, 6, 3, 3, 0, 1, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 11)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(resp) != 7 {
+		t.Errorf("expected transaction 7, got % x", resp[:2])
+	}
+	if want := []byte{3, 3, 2, 0xab, 0xcd}; string(resp[6:]) != string(want) {
+		t.Errorf("expected % x, got % x", want, resp[6:])
+	}
+	// A unit that is not held is answered with an exception rather than ignored.
+	if _, err := conn.Write([]byte{0, 8, 0, 0, 0, 6, 9, 3, 0, 1, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	resp = make([]byte, 9)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{9, 0x83, byte(unknownDevice)}; string(resp[6:]) != string(want) {
+		t.Errorf("expected % x, got % x", want, resp[6:])
+	}
+
+	// Requests shorter than a register request are answered too.
+	data := tcpRequest(t, conn, 3, funcReadDeviceIdentification, meiReadDeviceIdentification, identBasic, 0)
+	if objects := make(map[byte]string); len(data) < 2 || data[0] != funcReadDeviceIdentification {
+		t.Errorf("expected the device identification, got % x", data)
+	} else if _, err := parseDeviceIdentification(data[1:], objects); err != nil || objects[0] != "meterproxy" {
+		t.Errorf("unexpected device identification %v (%v)", objects, err)
+	}
+	if data := tcpRequest(t, conn, 3, 3, 0, 1); string(data) != string([]byte{0x83, byte(illegalDataValue)}) {
+		t.Errorf("expected a short read to be refused, got % x", data)
+	}
+
+	// A TCP port has no serial line to diagnose.
+	for _, pdu := range [][]byte{{funcGetCommEventCounter}, {funcGetCommEventLog}, {funcDiagnostics, 0, diagReturnQueryData, 0, 0}} {
+		if data := tcpRequest(t, conn, 3, pdu...); string(data) != string([]byte{pdu[0] | 0x80, byte(illegalFunction)}) {
+			t.Errorf("fc %d: expected Illegal Function, got % x", pdu[0], data)
+		}
+	}
+}
+
+// tcpRequest sends the PDU to the unit and returns the response PDU.
+func tcpRequest(t *testing.T, conn net.Conn, unit byte, pdu ...byte) []byte {
+	t.Helper()
+	req := binary.BigEndian.AppendUint16([]byte{0, 9, 0, 0}, uint16(len(pdu)+1))
+	if _, err := conn.Write(append(append(req, unit), pdu...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	hdr := make([]byte, mbapHeaderSz)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, int(binary.BigEndian.Uint16(hdr[4:]))-1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestTCPServerUnit(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(3)
+	regA, _ := getRegisterAccess(3, 3)
+	regA.Write(1, 1, []byte{0xab, 0xcd})
+
+	// Units 0 and 255 address the TCP server itself, which answers as its only unit.
+	sp := &serverPort{cfg: serverData{TCP: ":502", Units: []byte{3}}, name: "tcp"}
+	for _, unit := range []byte{0, 0xff} {
+		out := sp.handleRequest(&mbserver.RTUFrame{Address: unit, Function: 3, Data: []byte{0, 1, 0, 1}})
+		if want := []byte{unit, 3, 2, 0xab, 0xcd}; string(out[:len(out)-2]) != string(want) {
+			t.Errorf("unit %d: expected % x, got % x", unit, want, out)
+		}
+	}
+
+	// With more than one unit, the server cannot tell which is meant, and a write to unit 0
+	// is not a broadcast.
+	sp = &serverPort{cfg: serverData{TCP: ":502"}, name: "tcp"}
+	out := sp.handleRequest(&mbserver.RTUFrame{Address: 0, Function: 6, Data: []byte{0, 1, 0, 9}})
+	if want := []byte{0, 0x86, byte(unknownDevice)}; string(out[:len(out)-2]) != string(want) {
+		t.Errorf("expected % x, got % x", want, out)
+	}
+	if data, _ := regA.Read(1, 1); data[1] != 0xab {
+		t.Errorf("unit 0 write was performed: % x", data)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+/* Meter simulator.
+ * Emulates a meter for development without any RS485 hardware. The register map and the
+ * generator for each value come from the simulator section of the configuration. The
+ * values are stored in the usual register tables and served by the same code as the
+ * proxy's server, over a serial port, a pseudo-terminal and/or Modbus TCP.
+ */
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+type simRegister struct {
+	Name      string
+	Register  int
+	Type      string
+	Generator string
+	Value     float64
+	Amplitude float64
+	Period    float64
+	Step      float64
+	Min, Max  float64
+	Column    string
+}
+
+type simulatorData struct {
+	DeviceID   byte `yaml:"device_id"`
+	Devicename string
+	Baudrate   int
+	Parity     string
+	TCP        string
+	Interval   int
+	CSV        string
+	Registers  []simRegister
+}
+
+// csvData holds the columns of a CSV file used to replay values.
+type csvData struct {
+	columns map[string]int
+	rows    [][]float64
+}
+
+const defaultSimInterval = 1000
+
+func loadCSV(fn string) (*csvData, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	records, err := csv.NewReader(fh).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s: expected a header and at least one row", fn)
+	}
+	data := &csvData{columns: make(map[string]int)}
+	for n, name := range records[0] {
+		data.columns[name] = n
+	}
+	for ln, rec := range records[1:] {
+		row := make([]float64, len(rec))
+		for n, s := range rec {
+			if row[n], err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fn, ln+2, err)
+			}
+		}
+		data.rows = append(data.rows, row)
+	}
+	return data, nil
+}
+
+// simulate calculates the value for the register at the elapsed time. Random walks
+// start from, and update, the last value.
+func (sr *simRegister) simulate(elapsed time.Duration, tick int, last float64, data *csvData) (float64, error) {
+	var v float64
+	switch sr.Generator {
+	case "constant", "":
+		v = sr.Value
+	case "sine":
+		period := sr.Period
+		if period <= 0 {
+			period = 60
+		}
+		v = sr.Value + sr.Amplitude*math.Sin(2*math.Pi*elapsed.Seconds()/period)
+	case "random_walk":
+		if tick == 0 {
+			last = sr.Value
+		}
+		v = last + (rand.Float64()*2-1)*sr.Step
+	case "csv":
+		if data == nil {
+			return 0, fmt.Errorf("%s: csv generator used without a csv file", sr.Name)
+		}
+		col, ck := data.columns[sr.Column]
+		if !ck {
+			return 0, fmt.Errorf("%s: column %q not found in csv file", sr.Name, sr.Column)
+		}
+		row := data.rows[tick%len(data.rows)]
+		if col < len(row) {
+			v = row[col]
+		}
+	default:
+		return 0, fmt.Errorf("%s: unknown generator %q", sr.Name, sr.Generator)
+	}
+	if sr.Min < sr.Max {
+		v = math.Max(sr.Min, math.Min(sr.Max, v))
+	}
+	return v, nil
+}
+
+// updateSimulator calculates every register value and stores it in the device tables.
+func updateSimulator(sim simulatorData, elapsed time.Duration, tick int, last []float64, data *csvData) error {
+	for n := range sim.Registers {
+		sr := &sim.Registers[n]
+		v, err := sr.simulate(elapsed, tick, last[n], data)
+		if err != nil {
+			return err
+		}
+		last[n] = v
+		raw, err := encodeRegisterValue(sr.Type, v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", sr.Name, err)
+		}
+		typ, reg, err := parseRegister(sr.Register)
+		if err != nil {
+			return fmt.Errorf("%s: %v", sr.Name, err)
+		}
+		regA, mErr := getRegisterAccess(sim.DeviceID, registerTable(typ))
+		if mErr != modbusSuccess {
+			return fmt.Errorf("%s: register %d: %v", sr.Name, sr.Register, mErr)
+		}
+		if mErr = regA.Write(int(reg), registerSize(sr.Type), raw); mErr != modbusSuccess {
+			return fmt.Errorf("%s: register %d: %v", sr.Name, sr.Register, mErr)
+		}
+	}
+	return nil
+}
+
+// runSimulator starts serving the simulated meter and updates the values until stopped.
+func runSimulator(sim simulatorData, quitChannel chan bool) error {
+	if sim.DeviceID == 0 {
+		sim.DeviceID = defaultServerDevice
+	}
+	interval := time.Duration(sim.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultSimInterval * time.Millisecond
+	}
+	var data *csvData
+	if sim.CSV != "" {
+		var err error
+		if data, err = loadCSV(sim.CSV); err != nil {
+			return err
+		}
+	}
+
+	addStandardDevice(sim.DeviceID)
+	last := make([]float64, len(sim.Registers))
+	if err := updateSimulator(sim, 0, 0, last, data); err != nil {
+		return err
+	}
+
+	if sim.Devicename != "" {
+		cfg := rtuData{Devicename: sim.Devicename, Baudrate: sim.Baudrate, Parity: sim.Parity}
+		port, err := openSerialPort(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", sim.Devicename, err)
+		}
+		go newServerPort(serverData{rtuData: cfg}).serveSerialPort(port)
+		log.Printf("Simulator: device %d listening on %s", sim.DeviceID, sim.Devicename)
+	}
+	if sim.TCP != "" {
+		if err := newServerPort(serverData{TCP: sim.TCP}).startTCPServer(); err != nil {
+			return err
+		}
+	}
+	if sim.Devicename == "" && sim.TCP == "" {
+		ptmx, name, err := openPty()
+		if err != nil {
+			return fmt.Errorf("unable to create a pseudo-terminal: %v", err)
+		}
+		go func() {
+			if err := newServerPort(serverData{rtuData: rtuData{Devicename: name}}).acceptSerialRequests(ptmx); err != nil {
+				log.Printf("Simulator: %v", err)
+			}
+		}()
+		fmt.Printf("Simulated meter %d available on %s\n", sim.DeviceID, name)
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for tick := 1; ; tick++ {
+		select {
+		case <-quitChannel:
+			return nil
+		case <-ticker.C:
+			if err := updateSimulator(sim, time.Since(start), tick, last, data); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestUpdateSimulator(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(1)
+	sim := simulatorData{DeviceID: 1, Registers: []simRegister{
+		{Name: "Voltage", Register: 30001, Value: 240},
+		{Name: "Current", Register: 30007, Generator: "random_walk", Value: 5, Step: 100, Min: 0, Max: 10},
+		{Name: "Setting", Register: 40003, Type: "uint16", Value: 7},
+	}}
+	last := make([]float64, len(sim.Registers))
+	for tick := 0; tick < 5; tick++ {
+		if err := updateSimulator(sim, 0, tick, last, nil); err != nil {
+			t.Fatal(err)
+		}
+		if last[1] < 0 || last[1] > 10 {
+			t.Fatalf("random walk %v outside limits", last[1])
+		}
+	}
+
+	regA, _ := getRegisterAccess(1, 4)
+	data, _ := regA.Read(0, 2)
+	if v := math.Float32frombits(binary.BigEndian.Uint32(data[1:])); v != 240 {
+		t.Errorf("expected voltage 240, got %v", v)
+	}
+	regA, _ = getRegisterAccess(1, 3)
+	data, _ = regA.Read(2, 1)
+	if v := binary.BigEndian.Uint16(data[1:]); v != 7 {
+		t.Errorf("expected setting 7, got %d", v)
+	}
+}
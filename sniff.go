@@ -0,0 +1,251 @@
+package main
+
+/* Passive bus sniffer.
+ * Listens on a serial port connected to an existing bus, without ever transmitting, to
+ * see what the master asks for before the proxy is inserted. Frames are split using the
+ * function code and CRC, with a gap in the traffic used to discard any partial frame.
+ * Responses are matched with the request before them and the polls summarised, along
+ * with the ranges needed in the configuration for the proxy to answer them.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// sniffFlushGap is the silence after which incomplete bytes are discarded. It is much
+// longer than the 3.5 characters between frames, as USB adapters deliver bytes in bursts.
+const sniffFlushGap = 50 * time.Millisecond
+
+type pollKey struct {
+	unit     byte
+	function byte
+	start    uint16
+	count    uint16
+}
+
+type pollStats struct {
+	polls, exceptions, unanswered int
+	first, last                   time.Time
+}
+
+type sniffer struct {
+	out      io.Writer
+	pending  []byte
+	lastRx   time.Time
+	request  []byte
+	reqTime  time.Time
+	polls    map[pollKey]*pollStats
+	frames   int
+	discards int
+}
+
+func newSniffer(out io.Writer) *sniffer {
+	return &sniffer{out: out, polls: make(map[pollKey]*pollStats)}
+}
+
+// feed adds bytes read at the time given and handles any complete frames.
+func (sn *sniffer) feed(data []byte, now time.Time) {
+	if len(sn.pending) > 0 && now.Sub(sn.lastRx) > sniffFlushGap {
+		sn.extract(true)
+	}
+	sn.pending = append(sn.pending, data...)
+	sn.lastRx = now
+	sn.extract(false)
+}
+
+// extract handles every frame in the pending bytes. Bytes that do not start a valid
+// frame are dropped one at a time until the framing is found again. Unless final, an
+// incomplete frame is left for more bytes to arrive.
+func (sn *sniffer) extract(final bool) {
+	for len(sn.pending) > 0 {
+		frame, isRequest, more := sn.nextFrame()
+		if frame != nil {
+			sn.pending = sn.pending[len(frame):]
+			sn.handle(frame, isRequest)
+			continue
+		}
+		if more && !final {
+			return
+		}
+		sn.pending = sn.pending[1:]
+		sn.discards++
+	}
+}
+
+// nextFrame looks for a valid frame at the start of the pending bytes, trying a response
+// first if a request is waiting for one. Returns more as true if it may be incomplete.
+func (sn *sniffer) nextFrame() (frame []byte, isRequest bool, more bool) {
+	order := []bool{true, false}
+	if sn.request != nil {
+		order = []bool{false, true}
+	}
+	for _, isRequest := range order {
+		size := sn.frameLength(isRequest)
+		switch {
+		case size == 0 || size > len(sn.pending):
+			more = true
+		case size > 0 && validRTUFrame(sn.pending[:size]):
+			return sn.pending[:size], isRequest, false
+		}
+	}
+	return nil, false, more
+}
+
+func (sn *sniffer) frameLength(isRequest bool) int {
+	size := rtuFrameLength(sn.pending, isRequest)
+	if size > rtuMaxSz {
+		return -1
+	}
+	return size
+}
+
+func (sn *sniffer) handle(frame []byte, isRequest bool) {
+	sn.frames++
+	now := sn.lastRx
+	arrow := "<-"
+	if isRequest {
+		arrow = "->"
+		if sn.request != nil {
+			sn.record(sn.request, sn.reqTime, nil)
+		}
+		sn.request, sn.reqTime = append([]byte(nil), frame...), now
+	} else if sn.request != nil {
+		if frame[0] == sn.request[0] && frame[1]&0x7f == sn.request[1] {
+			sn.record(sn.request, sn.reqTime, frame)
+		}
+		sn.request = nil
+	}
+	fmt.Fprintf(sn.out, "%s %s % x  %s\n", now.Format("15:04:05.000"), arrow, frame, decodeFrame(frame, isRequest))
+}
+
+// record adds a request, and the response if there was one, to the summary.
+func (sn *sniffer) record(req []byte, when time.Time, resp []byte) {
+	key := pollKey{unit: req[0], function: req[1]}
+	if req[1] <= 4 && len(req) == rtuMinSz {
+		key.start = binary.BigEndian.Uint16(req[2:4])
+		key.count = binary.BigEndian.Uint16(req[4:6])
+	}
+	ps, ck := sn.polls[key]
+	if !ck {
+		ps = &pollStats{first: when}
+		sn.polls[key] = ps
+	}
+	ps.polls++
+	ps.last = when
+	switch {
+	case resp == nil:
+		ps.unanswered++
+	case resp[1]&0x80 != 0:
+		ps.exceptions++
+	}
+}
+
+func (sn *sniffer) sortedPolls() []pollKey {
+	keys := make([]pollKey, 0, len(sn.polls))
+	for key := range sn.polls {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.unit != b.unit {
+			return a.unit < b.unit
+		}
+		if a.function != b.function {
+			return a.function < b.function
+		}
+		return a.start < b.start
+	})
+	return keys
+}
+
+// summary writes what the master polled.
+func (sn *sniffer) summary(w io.Writer) {
+	fmt.Fprintf(w, "%d frames, %d bytes discarded\n", sn.frames, sn.discards)
+	for _, key := range sn.sortedPolls() {
+		ps := sn.polls[key]
+		desc := fmt.Sprintf("unit %d fc %d", key.unit, key.function)
+		if key.count > 0 {
+			desc += fmt.Sprintf(" registers %d-%d", key.start, int(key.start)+int(key.count)-1)
+		}
+		desc += fmt.Sprintf(": %d polls, %d exceptions, %d unanswered", ps.polls, ps.exceptions, ps.unanswered)
+		if ps.polls > 1 {
+			desc += fmt.Sprintf(", every %v", (ps.last.Sub(ps.first) / time.Duration(ps.polls-1)).Round(time.Millisecond))
+		}
+		fmt.Fprintln(w, desc)
+	}
+}
+
+// devices returns the ranges the proxy would need to poll to answer the master.
+func (sn *sniffer) devices() []remoteDevice {
+	var devs []remoteDevice
+	for _, key := range sn.sortedPolls() {
+		base := functionRegisterBase(key.function)
+		if base == 0 || key.count == 0 {
+			continue
+		}
+		if n := len(devs); n == 0 || devs[n-1].ID != key.unit {
+			devs = append(devs, remoteDevice{ID: key.unit})
+		}
+		dev := &devs[len(devs)-1]
+		dev.Ranges = append(dev.Ranges, regRange{Start: base + int(key.start),
+			Finish: base + int(key.start) + int(key.count), Delay: 100})
+	}
+	return devs
+}
+
+// runSniffer reads from the port until told to quit. The frames and summary are written
+// to out and the starter configuration to cfgOut.
+func runSniffer(cfg rtuData, out, cfgOut io.Writer, quitChannel chan bool) error {
+	port, err := openSerialPort(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", cfg.Devicename, err)
+	}
+	defer port.Close()
+	log.Printf("Sniffer: listening on %s", cfg.Devicename)
+
+	sn := newSniffer(out)
+	rx := make(chan []byte)
+	go func() {
+		buf := make([]byte, rtuMaxSz)
+		for {
+			n, err := port.Read(buf)
+			if err == serial.ErrTimeout {
+				continue
+			}
+			if err != nil {
+				log.Printf("Sniffer: %v", err)
+				close(rx)
+				return
+			}
+			rx <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+Loop:
+	for {
+		select {
+		case data, ok := <-rx:
+			if !ok {
+				break Loop
+			}
+			sn.feed(data, time.Now())
+		case <-quitChannel:
+			break Loop
+		}
+	}
+	sn.extract(true)
+
+	sn.summary(out)
+	devs := sn.devices()
+	if len(devs) == 0 {
+		return nil
+	}
+	return writeStarterConfig(cfgOut, []rtuData{{Devicename: cfg.Devicename, Baudrate: cfg.Baudrate, Parity: cfg.Parity, Devices: devs}})
+}
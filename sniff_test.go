@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// withCRC appends the CRC to the frame.
+func withCRC(frame ...byte) []byte {
+	return binary.LittleEndian.AppendUint16(frame, modbusCRC(frame))
+}
+
+func TestRTUFrameLength(t *testing.T) {
+	tests := []struct {
+		frame     []byte
+		isRequest bool
+		want      int
+	}{
+		{[]byte{1, 3, 0, 0, 0, 10}, true, 8},
+		{[]byte{1, 3, 20}, false, 25},
+		{[]byte{1, 16, 0, 0, 0, 2, 4}, true, 13},
+		{[]byte{1, 16}, true, 0},
+		{[]byte{1, 0x83, 2}, false, 5},
+		{[]byte{1, 43, 14, 1, 0x81, 0, 0, 2, 0, 3, 'A', 'B', 'C', 1, 1, 'X'}, false, 18},
+		{[]byte{1, 43, 14, 1, 0x81, 0, 0, 2, 0, 3, 'A', 'B', 'C'}, false, 0},
+		{[]byte{1, 99}, true, -1},
+	}
+	for _, tc := range tests {
+		if got := rtuFrameLength(tc.frame, tc.isRequest); got != tc.want {
+			t.Errorf("% x: expected %d got %d", tc.frame, tc.want, got)
+		}
+	}
+}
+
+func TestSnifferSummary(t *testing.T) {
+	req := withCRC(1, 4, 0, 10, 0, 2)
+	resp := withCRC(1, 4, 4, 0x43, 0x70, 0x80, 0)
+	holding := withCRC(1, 3, 0, 0, 0, 1)
+	exception := withCRC(1, 0x83, 2)
+
+	var stream []byte
+	stream = append(stream, 0xff, 0x00) // noise before the first frame
+	for n := 0; n < 3; n++ {
+		stream = append(stream, req...)
+		stream = append(stream, resp...)
+	}
+	stream = append(stream, holding...)
+	stream = append(stream, exception...)
+	stream = append(stream, holding...) // never answered
+	stream = append(stream, req...)
+	stream = append(stream, resp...)
+
+	sn := newSniffer(io.Discard)
+	now := time.Now()
+	// Deliver the bytes in uneven chunks, as a USB adapter would.
+	for len(stream) > 0 {
+		n := min(5, len(stream))
+		sn.feed(stream[:n], now)
+		stream = stream[n:]
+		now = now.Add(time.Millisecond)
+	}
+	sn.extract(true)
+
+	if sn.frames != 11 || sn.discards != 2 {
+		t.Errorf("expected 11 frames and 2 bytes discarded, got %d and %d", sn.frames, sn.discards)
+	}
+	input := sn.polls[pollKey{1, 4, 10, 2}]
+	if input == nil || input.polls != 4 || input.exceptions != 0 {
+		t.Errorf("unexpected input polls %+v", input)
+	}
+	hold := sn.polls[pollKey{1, 3, 0, 1}]
+	if hold == nil || hold.polls != 2 || hold.exceptions != 1 || hold.unanswered != 1 {
+		t.Errorf("unexpected holding polls %+v", hold)
+	}
+
+	devs := sn.devices()
+	want := []regRange{{Start: 40001, Finish: 40002, Delay: 100}, {Start: 30011, Finish: 30013, Delay: 100}}
+	if len(devs) != 1 || devs[0].ID != 1 || len(devs[0].Ranges) != 2 || devs[0].Ranges[0] != want[0] || devs[0].Ranges[1] != want[1] {
+		t.Errorf("unexpected devices %+v", devs)
+	}
+}
+
+func TestSnifferDiscardsPartialFrame(t *testing.T) {
+	req := withCRC(2, 3, 0, 0, 0, 4)
+	sn := newSniffer(io.Discard)
+	now := time.Now()
+	sn.feed(req[:5], now)
+	sn.feed(req, now.Add(sniffFlushGap*2))
+	if sn.frames != 1 || sn.discards != 5 {
+		t.Errorf("expected 1 frame and 5 bytes discarded, got %d and %d", sn.frames, sn.discards)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+/* Modbus TCP transport for the server.
+ * Requests are converted to RTU frames and handled by the port as for serial ports.
+ * The RTU response is converted back to Modbus TCP by the tcpResponder it is written to.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/tbrandon/mbserver"
+)
+
+const mbapHeaderSz = 7
+
+// tcpResponder wraps the connection for a single request, so the response carries the
+// transaction ID of the request.
+type tcpResponder struct {
+	net.Conn
+	transaction uint16
+}
+
+func (tr *tcpResponder) Write(adu []byte) (int, error) {
+	if len(adu) < 4 {
+		return 0, fmt.Errorf("response too short: % x", adu)
+	}
+	pdu := adu[1 : len(adu)-2]
+	out := make([]byte, mbapHeaderSz, mbapHeaderSz+len(pdu))
+	binary.BigEndian.PutUint16(out[0:], tr.transaction)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(pdu)+1))
+	out[6] = adu[0]
+	if _, err := tr.Conn.Write(append(out, pdu...)); err != nil {
+		return 0, err
+	}
+	return len(adu), nil
+}
+
+func (sp *serverPort) startTCPServer() error {
+	ln, err := net.Listen("tcp", sp.cfg.TCP)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", sp.cfg.TCP, err)
+	}
+	go sp.acceptTCPConnections(ln)
+	log.Printf("Server: Started listening for Modbus TCP on %s", sp.cfg.TCP)
+	return nil
+}
+
+func (sp *serverPort) acceptTCPConnections(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Server: %v", err)
+			return
+		}
+		go sp.acceptTCPRequests(conn)
+	}
+}
+
+// acceptTCPRequests reads requests from the connection until it is closed.
+func (sp *serverPort) acceptTCPRequests(conn net.Conn) error {
+	defer conn.Close()
+	hdr := make([]byte, mbapHeaderSz)
+	for {
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(hdr[4:6]))
+		if binary.BigEndian.Uint16(hdr[2:4]) != 0 || length < 2 || length > 254 {
+			return fmt.Errorf("invalid MBAP header from %s: % x", conn.RemoteAddr(), hdr)
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return err
+		}
+		frame := &mbserver.RTUFrame{Address: hdr[6], Function: pdu[0], Data: pdu[1:]}
+		sp.requests <- &request{&tcpResponder{Conn: conn, transaction: binary.BigEndian.Uint16(hdr[0:2])}, frame}
+	}
+}
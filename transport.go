@@ -0,0 +1,129 @@
+package main
+
+/* RTU transport.
+ * The serial port for a bus, shared by every device on it, used in place of the goburrow
+ * transporter. goburrow works out the length of a response from the function code, so
+ * for functions it does not know, such as FC43, it only reads the first few bytes. Here
+ * the response is read until the framing shows it is complete, giving up once nothing
+ * more arrives within the timeout.
+ * Each request and its response is a single transaction, holding the lock, so requests
+ * from the collector and the API never interleave on the bus.
+ */
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+type rtuPort struct {
+	mu      sync.Mutex
+	cfg     rtuData
+	timeout time.Duration
+	port    io.ReadWriteCloser
+}
+
+func newRTUPort(cfg rtuData, timeout time.Duration) *rtuPort {
+	return &rtuPort{cfg: cfg, timeout: timeout}
+}
+
+// open opens the port if it is not already open. Must be called with the lock held.
+func (rp *rtuPort) open() error {
+	if rp.port != nil {
+		return nil
+	}
+	port, err := serial.Open(&serial.Config{
+		Address:  rp.cfg.Devicename,
+		BaudRate: rp.cfg.Baudrate,
+		DataBits: 8,
+		StopBits: 1,
+		Parity:   rp.cfg.Parity,
+		Timeout:  rp.timeout,
+	})
+	if err != nil {
+		return err
+	}
+	rp.port = port
+	return nil
+}
+
+func (rp *rtuPort) Connect() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.open()
+}
+
+// Close closes the port, which is opened again by the next request.
+func (rp *rtuPort) Close() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.port == nil {
+		return nil
+	}
+	err := rp.port.Close()
+	rp.port = nil
+	return err
+}
+
+// setDevicename changes the device the port is opened on, once it is next opened.
+func (rp *rtuPort) setDevicename(name string) {
+	rp.mu.Lock()
+	rp.cfg.Devicename = name
+	rp.mu.Unlock()
+}
+
+// frameDelay is the silence (3.5 characters) required between frames.
+func (rp *rtuPort) frameDelay() time.Duration {
+	if rp.cfg.Baudrate <= 0 || rp.cfg.Baudrate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(35000000/rp.cfg.Baudrate) * time.Microsecond
+}
+
+// Send writes the request and returns the response.
+func (rp *rtuPort) Send(aduRequest []byte) ([]byte, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err := rp.open(); err != nil {
+		return nil, err
+	}
+	time.Sleep(rp.frameDelay())
+	if _, err := rp.port.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	return readRTUResponse(rp.port, rp.timeout)
+}
+
+// readRTUResponse reads a response frame, failing if nothing more arrives within the
+// timeout before it is complete.
+func readRTUResponse(port io.Reader, timeout time.Duration) ([]byte, error) {
+	var resp []byte
+	buf := make([]byte, rtuMaxSz)
+	idle := time.Now().Add(timeout)
+	for {
+		n, err := port.Read(buf)
+		if n > 0 {
+			resp = append(resp, buf[:n]...)
+			idle = time.Now().Add(timeout)
+		}
+		size := rtuFrameLength(resp, false)
+		switch {
+		case size < 0 || size > rtuMaxSz:
+			return nil, fmt.Errorf("unexpected response % x", resp)
+		case size > 0 && len(resp) >= size:
+			return resp[:size], nil
+		}
+		if err != nil && err != serial.ErrTimeout {
+			return nil, err
+		}
+		if err == serial.ErrTimeout || time.Now().After(idle) {
+			if len(resp) == 0 {
+				return nil, fmt.Errorf("no response within %v", timeout)
+			}
+			return nil, fmt.Errorf("incomplete response % x", resp)
+		}
+	}
+}
@@ -1,52 +1,170 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
 const DEV_PATH = "/sys/bus/usb/devices"
 
+// usbSerialAdapter is a tty provided by a USB device, along with the details that can
+// be used to identify it regardless of the order devices were enumerated.
+type usbSerialAdapter struct {
+	Tty       string
+	Serial    string
+	VendorID  string
+	ProductID string
+	PortPath  string
+	Product   string
+}
+
 var (
-	devRe            regexp.Regexp = *regexp.MustCompile(`[0-9]-[0-9]`)
+	devRe            regexp.Regexp = *regexp.MustCompile(`^[0-9]+-[0-9]+(\.[0-9]+)*$`)
 	usbSerialDevices               = make(map[string]bool, 10)
-	usbSerialRe                    = regexp.MustCompile(`(?i)usb.*serial|serial.*usb`)
+	usbSysfsPath                   = DEV_PATH
 )
 
-func findUSBSerialDevices() {
-	files, err := filepath.Glob(filepath.Join(DEV_PATH, "usb*"))
+func (ua usbSerialAdapter) String() string {
+	return fmt.Sprintf("/dev/%s (serial %q, vid_pid %s:%s, port_path %s, %s)", ua.Tty, ua.Serial,
+		ua.VendorID, ua.ProductID, ua.PortPath, ua.Product)
+}
+
+// scanUSBSerialAdapters finds every USB device under the sysfs root that has a tty.
+func scanUSBSerialAdapters(root string) []usbSerialAdapter {
+	entries, err := os.ReadDir(root)
 	if err != nil {
-		log.Fatalf("No USB devices available: %v", err)
+		log.Printf("No USB devices available: %v", err)
+		return nil
 	}
 
-	for _, poss := range files {
-		productFnGlob := filepath.Join(poss, "*", "product")
-		files, err := filepath.Glob(productFnGlob)
-		if err != nil || len(files) == 0 {
+	var adapters []usbSerialAdapter
+	for _, entry := range entries {
+		if !devRe.MatchString(entry.Name()) {
 			continue
 		}
-		for _, prodFn := range files {
-			product := readFile(prodFn)
-			if !usbSerialRe.MatchString(product) {
+		devDir := filepath.Join(root, entry.Name())
+		// USB serial drivers put the tty directly in the interface directory, while
+		// CDC ACM devices have it below a tty class directory.
+		ttys, _ := filepath.Glob(filepath.Join(devDir, "*:*", "tty*"))
+		classTtys, _ := filepath.Glob(filepath.Join(devDir, "*:*", "tty", "tty*"))
+		for _, tty := range append(ttys, classTtys...) {
+			name := filepath.Base(tty)
+			if name == "tty" {
 				continue
 			}
-			ttyGlob := filepath.Join(filepath.Dir(prodFn), "*:*", "tty*")
-			//fmt.Printf("Looking for TTY's: %s\n", ttyGlob)
-			ttys, err := filepath.Glob(ttyGlob)
-			if err != nil || len(ttys) == 0 {
-				continue
-			}
-			found := filepath.Base(ttys[0])
-			_, ck := usbSerialDevices[found]
-			if !ck {
-				usbSerialDevices[found] = false
-			}
+			adapters = append(adapters, usbSerialAdapter{
+				Tty:       name,
+				Serial:    readFile(filepath.Join(devDir, "serial")),
+				VendorID:  strings.ToLower(readFile(filepath.Join(devDir, "idVendor"))),
+				ProductID: strings.ToLower(readFile(filepath.Join(devDir, "idProduct"))),
+				PortPath:  entry.Name(),
+				Product:   readFile(filepath.Join(devDir, "product")),
+			})
+		}
+	}
+	sort.Slice(adapters, func(i, j int) bool { return adapters[i].Tty < adapters[j].Tty })
+	return adapters
+}
+
+func findUSBSerialDevices() {
+	for _, adapter := range scanUSBSerialAdapters(usbSysfsPath) {
+		_, ck := usbSerialDevices[adapter.Tty]
+		if !ck {
+			usbSerialDevices[adapter.Tty] = false
+		}
+	}
+}
+
+// usesUSBSelector returns true if the port is identified by its USB details rather than name.
+func (rtu rtuData) usesUSBSelector() bool {
+	return rtu.Serial != "" || rtu.VidPid != "" || rtu.PortPath != ""
+}
+
+func (rtu rtuData) matches(ua usbSerialAdapter) bool {
+	if rtu.Serial != "" && rtu.Serial != ua.Serial {
+		return false
+	}
+	if rtu.VidPid != "" && !strings.EqualFold(rtu.VidPid, ua.VendorID+":"+ua.ProductID) {
+		return false
+	}
+	if rtu.PortPath != "" && rtu.PortPath != ua.PortPath {
+		return false
+	}
+	return true
+}
+
+// resolveUSBDevice sets the devicename for a port identified by its USB details.
+func resolveUSBDevice(rtu *rtuData, adapters []usbSerialAdapter) error {
+	if !rtu.usesUSBSelector() {
+		return nil
+	}
+	var found []usbSerialAdapter
+	for _, ua := range adapters {
+		if rtu.matches(ua) {
+			found = append(found, ua)
+		}
+	}
+	desc := fmt.Sprintf("serial %q, vid_pid %q, port_path %q", rtu.Serial, rtu.VidPid, rtu.PortPath)
+	switch len(found) {
+	case 0:
+		var avail []string
+		for _, ua := range adapters {
+			avail = append(avail, ua.String())
+		}
+		return fmt.Errorf("no USB serial adapter matches %s. Available: %s", desc, strings.Join(avail, ", "))
+	case 1:
+		dev := filepath.Join("/dev", found[0].Tty)
+		if rtu.Devicename != "" && rtu.Devicename != dev {
+			log.Printf("USB adapter matching %s is %s, ignoring configured devicename %s", desc, dev, rtu.Devicename)
+		}
+		rtu.Devicename = dev
+		return nil
+	default:
+		var ambig []string
+		for _, ua := range found {
+			ambig = append(ambig, ua.String())
+		}
+		return fmt.Errorf("%s matches more than one USB serial adapter: %s", desc, strings.Join(ambig, ", "))
+	}
+}
+
+// resolveUSBDevices resolves every port in the configuration that is identified by its USB details.
+func resolveUSBDevices(cfg *configData) error {
+	uses := cfg.Server.usesUSBSelector()
+	for _, sd := range cfg.Servers {
+		uses = uses || sd.usesUSBSelector()
+	}
+	for _, client := range cfg.Clients {
+		uses = uses || client.usesUSBSelector()
+	}
+	if !uses {
+		return nil
+	}
+
+	adapters := scanUSBSerialAdapters(usbSysfsPath)
+	if err := resolveUSBDevice(&cfg.Server.rtuData, adapters); err != nil {
+		return fmt.Errorf("server: %v", err)
+	}
+	for n := range cfg.Servers {
+		if cfg.Servers[n].TCP != "" {
+			continue
+		}
+		if err := resolveUSBDevice(&cfg.Servers[n].rtuData, adapters); err != nil {
+			return fmt.Errorf("server %d: %v", n, err)
+		}
+	}
+	for n := range cfg.Clients {
+		if err := resolveUSBDevice(&cfg.Clients[n], adapters); err != nil {
+			return fmt.Errorf("client %d: %v", n, err)
 		}
 	}
+	return nil
 }
 
 func readFile(fn string) (rStr string) {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeUSBDevice struct {
+	port, vendor, product, serial, tty string
+	acm                                bool
+}
+
+// makeFakeSysfs builds a minimal copy of /sys/bus/usb/devices.
+func makeFakeSysfs(t *testing.T, devs []fakeUSBDevice) string {
+	t.Helper()
+	root := t.TempDir()
+	write := func(fn, data string) {
+		if err := os.WriteFile(fn, []byte(data+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dev := range devs {
+		devDir := filepath.Join(root, dev.port)
+		ttyDir := filepath.Join(devDir, dev.port+":1.0", dev.tty)
+		if dev.acm {
+			ttyDir = filepath.Join(devDir, dev.port+":1.0", "tty", dev.tty)
+		}
+		if err := os.MkdirAll(ttyDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		write(filepath.Join(devDir, "idVendor"), dev.vendor)
+		write(filepath.Join(devDir, "idProduct"), dev.product)
+		write(filepath.Join(devDir, "product"), "USB Serial")
+		if dev.serial != "" {
+			write(filepath.Join(devDir, "serial"), dev.serial)
+		}
+		// Interfaces also appear at the top level, and should be ignored.
+		if err := os.MkdirAll(filepath.Join(root, dev.port+":1.0"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A hub without a tty.
+	if err := os.MkdirAll(filepath.Join(root, "1-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestResolveUSBDevice(t *testing.T) {
+	root := makeFakeSysfs(t, []fakeUSBDevice{
+		{port: "1-1.2", vendor: "0403", product: "6001", serial: "A10KXYZ1", tty: "ttyUSB1"},
+		{port: "1-1.3", vendor: "0403", product: "6001", serial: "A10KXYZ2", tty: "ttyUSB0"},
+		{port: "1-1.4", vendor: "1A86", product: "7523", tty: "ttyUSB2"},
+		{port: "1-1.5", vendor: "2341", product: "0043", serial: "ACM1", tty: "ttyACM0", acm: true},
+	})
+	adapters := scanUSBSerialAdapters(root)
+	if len(adapters) != 4 {
+		t.Fatalf("expected 4 adapters, got %d: %v", len(adapters), adapters)
+	}
+
+	for _, tc := range []struct {
+		cfg  rtuData
+		want string
+		err  string
+	}{
+		{cfg: rtuData{Devicename: "/dev/ttyUSB0"}, want: "/dev/ttyUSB0"},
+		{cfg: rtuData{Serial: "A10KXYZ1"}, want: "/dev/ttyUSB1"},
+		{cfg: rtuData{Devicename: "/dev/ttyUSB1", Serial: "A10KXYZ2"}, want: "/dev/ttyUSB0"},
+		{cfg: rtuData{VidPid: "1a86:7523"}, want: "/dev/ttyUSB2"},
+		{cfg: rtuData{PortPath: "1-1.5"}, want: "/dev/ttyACM0"},
+		{cfg: rtuData{VidPid: "0403:6001", PortPath: "1-1.3"}, want: "/dev/ttyUSB0"},
+		{cfg: rtuData{VidPid: "0403:6001"}, err: "matches more than one USB serial adapter"},
+		{cfg: rtuData{Serial: "MISSING"}, err: "no USB serial adapter matches"},
+	} {
+		cfg := tc.cfg
+		err := resolveUSBDevice(&cfg, adapters)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%+v: expected error containing %q, got %v", tc.cfg, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", tc.cfg, err)
+			continue
+		}
+		if cfg.Devicename != tc.want {
+			t.Errorf("%+v: got %s want %s", tc.cfg, cfg.Devicename, tc.want)
+		}
+	}
+}
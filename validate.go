@@ -0,0 +1,465 @@
+package main
+
+/* Validation of the configuration.
+ * Problems that would otherwise only be found at runtime (or never) are reported with the
+ * line of the configuration file they relate to. Errors prevent the configuration being
+ * used, while warnings are logged.
+ */
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type configIssue struct {
+	Line    int
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (ci configIssue) String() string {
+	level := "error"
+	if ci.Warning {
+		level = "warning"
+	}
+	if ci.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s: %s", ci.Line, level, ci.Path, ci.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", level, ci.Path, ci.Message)
+}
+
+type configValidator struct {
+	root   *yaml.Node
+	issues []configIssue
+}
+
+// configPath is a list of mapping keys (string) and sequence indexes (int).
+type configPath []interface{}
+
+func (p configPath) with(elems ...interface{}) configPath {
+	np := make(configPath, 0, len(p)+len(elems))
+	return append(append(np, p...), elems...)
+}
+
+func (p configPath) String() string {
+	var sb strings.Builder
+	for _, elem := range p {
+		switch e := elem.(type) {
+		case int:
+			fmt.Fprintf(&sb, "[%d]", e)
+		default:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			fmt.Fprintf(&sb, "%v", e)
+		}
+	}
+	return sb.String()
+}
+
+// line returns the line of the node at the path, or of the closest parent that exists.
+func (cv *configValidator) line(path configPath) int {
+	node := cv.root
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range path {
+		var next *yaml.Node
+		switch e := elem.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+				next = node.Content[e]
+			}
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for n := 0; n+1 < len(node.Content); n += 2 {
+					if node.Content[n].Value == e {
+						next = node.Content[n+1]
+						break
+					}
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+func (cv *configValidator) add(warning bool, path configPath, format string, args ...interface{}) {
+	cv.issues = append(cv.issues, configIssue{Line: cv.line(path), Path: path.String(),
+		Message: fmt.Sprintf(format, args...), Warning: warning})
+}
+
+func (cv *configValidator) errorf(path configPath, format string, args ...interface{}) {
+	cv.add(false, path, format, args...)
+}
+
+func (cv *configValidator) warnf(path configPath, format string, args ...interface{}) {
+	cv.add(true, path, format, args...)
+}
+
+// polledRange is the block of registers read by a single configured range.
+type polledRange struct {
+	opType     int
+	start, end int
+}
+
+func validateConfiguration(cfg *configData, root *yaml.Node) []configIssue {
+	cv := configValidator{root: root}
+
+	if len(cfg.serverPorts()) == 0 && len(cfg.Simulator.Registers) == 0 {
+		cv.errorf(configPath{"server", "devicename"}, "no server device configured")
+	}
+	ports := make(map[string]configPath)
+	serverPaths := serverPortPaths(cfg)
+	for n, sd := range cfg.serverPorts() {
+		sp := serverPaths[n]
+		switch {
+		case sd.TCP != "" && (sd.Devicename != "" || sd.usesUSBSelector()):
+			cv.errorf(sp.with("tcp"), "a server port is either a serial device or tcp, not both")
+		case sd.TCP == "" && sd.Devicename == "" && !sd.usesUSBSelector():
+			cv.errorf(sp, "no device or tcp address configured for server port")
+		case sd.name() != "":
+			np := sp.with("devicename")
+			if sd.TCP != "" {
+				np = sp.with("tcp")
+			}
+			if prev, ck := ports[sd.name()]; ck {
+				cv.errorf(np, "%s is already used by the server port at line %d", sd.name(), cv.line(prev))
+			} else {
+				ports[sd.name()] = np
+			}
+		}
+	}
+	if len(cfg.Clients) == 0 && len(cfg.Simulator.Registers) == 0 {
+		cv.warnf(configPath{"clients"}, "no clients configured, the server will only return zeros")
+	}
+
+	seen := make(map[byte]configPath)
+	polled := make(map[byte][]polledRange)
+	for ci, client := range cfg.Clients {
+		cp := configPath{"clients", ci}
+		if client.Devicename == "" && !client.usesUSBSelector() {
+			cv.errorf(cp.with("devicename"), "no device configured for client")
+		} else if _, ck := ports[client.Devicename]; ck && client.Devicename != "" {
+			cv.errorf(cp.with("devicename"), "%s is also used by the server", client.Devicename)
+		}
+		upstream := make(map[byte]configPath)
+		for di, dev := range client.Devices {
+			dp := cp.with("devices", di)
+			if dev.ID < 1 || dev.ID > maxUnitID {
+				cv.errorf(dp.with("id"), "device id %d is not a unit ID, which are 1 to %d", dev.ID, maxUnitID)
+			}
+			if dev.ExposeAs > maxUnitID {
+				cv.errorf(dp.with("expose_as"), "device id %d is not a unit ID, which are 1 to %d", dev.ExposeAs, maxUnitID)
+			}
+			if prev, ck := upstream[dev.ID]; ck {
+				cv.errorf(dp.with("id"), "device id %d is already configured on this client at line %d", dev.ID, cv.line(prev))
+			} else {
+				upstream[dev.ID] = dp.with("id")
+			}
+			id, ip := dev.exposedID(), dp.with("id")
+			if dev.ExposeAs != 0 {
+				ip = dp.with("expose_as")
+			}
+			if prev, ck := seen[id]; ck {
+				cv.errorf(ip, "device id %d is already exposed at line %d, exposed IDs must be unique across all clients, use expose_as to present the device as another ID",
+					id, cv.line(prev))
+			} else {
+				seen[id] = ip
+			}
+			if len(dev.Ranges) == 0 {
+				cv.warnf(dp, "no register ranges configured for device %d", dev.ID)
+			}
+			cv.checkIdentification(dp.with("identification"), dev.Identification)
+			for ri, rng := range dev.Ranges {
+				rp := dp.with("ranges", ri)
+				if pr, ok := cv.checkRange(rp, rng.Start, rng.Finish, rng.Offset); ok {
+					polled[id] = append(polled[id], pr)
+				}
+			}
+		}
+	}
+
+	for n, sd := range cfg.serverPorts() {
+		sp := serverPaths[n]
+		for ui, id := range sd.Units {
+			up := sp.with("units", ui)
+			if id == 0 {
+				cv.errorf(up, "unit 0 is the broadcast address")
+			} else if _, ck := seen[id]; !ck && id != defaultServerDevice && !hasVirtualDevice(cfg, id) {
+				cv.warnf(up, "unit %d is not polled by any client", id)
+			}
+		}
+		if sd.Shared && sd.TCP != "" {
+			cv.warnf(sp.with("shared"), "shared only applies to serial ports")
+		} else if sd.Shared && len(sd.Units) == 0 {
+			cv.warnf(sp.with("shared"), "the port is on a shared bus but answers every unit held, list the units exposed")
+		}
+		ap := sp.with("access")
+		for fi, fn := range sd.Access.Functions {
+			if fn == 0 || fn >= 0x80 {
+				cv.errorf(ap.with("functions", fi), "%d is not a valid function code", fn)
+			} else if sd.Access.ReadOnly && writeFunction(fn) {
+				cv.warnf(ap.with("functions", fi), "function %d writes, but the port is read only", fn)
+			}
+		}
+		for ri, rng := range sd.Access.Ranges {
+			cv.checkRange(ap.with("ranges", ri), rng.Start, rng.Finish, 0)
+		}
+	}
+
+	src := configPath{"source"}
+	if len(cfg.Source.Fields) > 0 {
+		if _, ck := seen[cfg.Source.DeviceID]; !ck {
+			cv.warnf(src.with("device_id"), "source device %d is not polled by any client", cfg.Source.DeviceID)
+		}
+	}
+	uids := make(map[string]int)
+	for fi, fld := range cfg.Source.Fields {
+		fp := src.with("fields", fi)
+		if fld.Name == "" {
+			cv.errorf(fp, "field has no name")
+		}
+		if prev, ck := uids[fld.uid]; ck {
+			cv.warnf(fp.with("name"), "field %q has the same MQTT topic as the field at line %d", fld.Name, prev)
+		}
+		uids[fld.uid] = cv.line(fp.with("name"))
+		if !rangeCovers(polled[cfg.Source.DeviceID], 3, fld.Idx, 2) {
+			cv.warnf(fp.with("idx"), "registers %d-%d are not in any input register range polled for device %d",
+				fld.Idx, fld.Idx+1, cfg.Source.DeviceID)
+		}
+	}
+
+	for wi, wr := range cfg.HTTP.Writable {
+		wp := configPath{"http", "writable", wi}
+		pr, ok := cv.checkRange(wp, wr.Start, wr.Finish, 0)
+		if ok && pr.opType != 4 {
+			cv.errorf(wp.with("start"), "only holding (4xxxx) registers can be written")
+		}
+		if _, ck := seen[wr.Device]; !ck {
+			cv.warnf(wp.with("device"), "device %d is not polled by any client, so cannot be written", wr.Device)
+		}
+	}
+	for vi, ov := range cfg.Virtual {
+		vp := configPath{"virtual", vi}
+		if ov.Device == 0 {
+			cv.errorf(vp.with("device"), "device 0 is the broadcast address")
+		}
+		typ, reg, err := parseRegister(ov.Register)
+		switch {
+		case err != nil:
+			cv.errorf(vp.with("register"), "%v", err)
+		case typ != 3 && typ != 4:
+			cv.errorf(vp.with("register"), "register %d is not an input (3xxxx) or holding (4xxxx) register", ov.Register)
+		case int(reg)+registerSize(ov.Type) > len(registerData{}):
+			cv.errorf(vp.with("register"), "register %d is beyond the %d registers held for each device", ov.Register, len(registerData{}))
+		}
+		if !validValueType(ov.Type) {
+			cv.errorf(vp.with("type"), "unknown value type %q", ov.Type)
+		}
+		switch {
+		case ov.Value != nil && ov.Expression != "":
+			cv.errorf(vp.with("expression"), "only one of value and expression can be given")
+		case ov.Value == nil && ov.Expression == "":
+			cv.errorf(vp, "a value or expression is required")
+		case ov.Expression != "":
+			expr, err := parseExpression(ov.Expression, ov.Type)
+			if err != nil {
+				cv.errorf(vp.with("expression"), "%v", err)
+				break
+			}
+			for _, ref := range expr.refs() {
+				if _, ck := seen[ref.device]; !ck && !hasVirtualDevice(cfg, ref.device) {
+					cv.warnf(vp.with("expression"), "device %d is not polled by any client", ref.device)
+				}
+			}
+		}
+	}
+
+	aggregates := make(map[byte]configPath)
+	for ai, agg := range cfg.Aggregates {
+		ap := configPath{"aggregates", ai}
+		prev, dup := aggregates[agg.Device]
+		switch {
+		case agg.Device == 0:
+			cv.errorf(ap.with("device"), "device 0 is the broadcast address")
+		case agg.Device > maxUnitID:
+			cv.errorf(ap.with("device"), "device id %d is not a unit ID, which are 1 to %d", agg.Device, maxUnitID)
+		case dup:
+			cv.errorf(ap.with("device"), "device %d is already the aggregate at line %d", agg.Device, cv.line(prev))
+		case virtualDeviceUsed(cfg, agg.Device):
+			cv.errorf(ap.with("device"), "device %d has virtual registers, an aggregate needs an unused device id", agg.Device)
+		default:
+			if _, ck := seen[agg.Device]; ck {
+				cv.errorf(ap.with("device"), "device %d is polled by a client, an aggregate needs an unused device id", agg.Device)
+			}
+		}
+		if !dup {
+			aggregates[agg.Device] = ap.with("device")
+		}
+		if _, err := findMeterLayout(cfg.layouts, agg.Layout); err != nil {
+			cv.errorf(ap.with("layout"), "%v", err)
+		}
+		if len(agg.Sources) == 0 {
+			cv.errorf(ap, "no sources configured for aggregate device %d", agg.Device)
+		}
+		if agg.Identification.Mirror {
+			cv.errorf(ap.with("identification", "mirror"), "an aggregate has no upstream device to mirror")
+		}
+		cv.checkIdentification(ap.with("identification"), agg.Identification)
+		for si, src := range agg.Sources {
+			sp := ap.with("sources", si)
+			if src.Layout != "" {
+				if _, err := findMeterLayout(cfg.layouts, src.Layout); err != nil {
+					cv.errorf(sp.with("layout"), "%v", err)
+				}
+			}
+			if _, ck := seen[src.Device]; !ck && !hasVirtualDevice(cfg, src.Device) {
+				cv.warnf(sp.with("device"), "device %d is not polled by any client", src.Device)
+			}
+			for pi, phase := range src.Phases {
+				if phase < 1 || phase > 3 {
+					cv.errorf(sp.with("phases", pi), "phase %d is not 1, 2 or 3", phase)
+				}
+			}
+		}
+	}
+
+	if cfg.Learn.Enabled && cfg.Learn.File == "" {
+		cv.warnf(configPath{"learn", "enabled"}, "no learn file configured, learned ranges will be lost on restart")
+	}
+	sort.SliceStable(cv.issues, func(i, j int) bool { return cv.issues[i].Line < cv.issues[j].Line })
+	return cv.issues
+}
+
+// serverPortPaths returns the configuration path of each of the server ports.
+func serverPortPaths(cfg *configData) []configPath {
+	var paths []configPath
+	if cfg.Server.name() != "" || cfg.Server.usesUSBSelector() {
+		paths = append(paths, configPath{"server"})
+	}
+	for si := range cfg.Servers {
+		paths = append(paths, configPath{"servers", si})
+	}
+	return paths
+}
+
+// checkIdentification checks that the objects fit in a response and extended objects
+// have extended object IDs.
+func (cv *configValidator) checkIdentification(path configPath, id identificationData) {
+	objects := id.objects()
+	var ids []int
+	for n := range objects {
+		ids = append(ids, int(n))
+	}
+	sort.Ints(ids)
+	for _, n := range ids {
+		if _, ck := id.Extended[byte(n)]; ck && n < 0x80 {
+			cv.errorf(path.with("extended", fmt.Sprint(n)), "object %d is not an extended object, which are 128 to 255", n)
+		}
+		if len(objects[byte(n)]) > identMaxValue {
+			cv.errorf(path, "object %d is longer than %d bytes", n, identMaxValue)
+		}
+	}
+}
+
+// checkRange validates a start/finish pair of register numbers such as 40001, held offset
+// registers lower, returning the range held.
+func (cv *configValidator) checkRange(path configPath, start, finish, offset int) (polledRange, bool) {
+	sType, sReg, err := parseRegister(start)
+	if err != nil {
+		cv.errorf(path.with("start"), "%v", err)
+		return polledRange{}, false
+	}
+	fType, fReg, err := parseRegister(finish)
+	if err != nil {
+		cv.errorf(path.with("finish"), "%v", err)
+		return polledRange{}, false
+	}
+	switch {
+	case sType != 3 && sType != 4:
+		cv.errorf(path.with("start"), "register %d is not an input (3xxxx) or holding (4xxxx) register", start)
+	case sType != fType:
+		cv.errorf(path.with("finish"), "range types do not match, %d vs %d", sType, fType)
+	case fReg < sReg:
+		cv.errorf(path.with("finish"), "finish register %d is lower than start register %d", finish, start)
+	case offset < 0 || offset > int(sReg):
+		cv.errorf(path.with("offset"), "offset %d is not between 0 and the start register %d", offset, sReg)
+	case int(fReg)-offset >= len(registerData{}) && offset > 0:
+		cv.errorf(path.with("finish"), "register %d is held as %d, beyond the %d registers held for each device, increase the offset",
+			finish, int(fReg)-offset, len(registerData{}))
+	case int(fReg)-offset >= len(registerData{}):
+		cv.errorf(path.with("finish"), "register %d is beyond the %d registers held for each device, use an offset to hold it lower",
+			finish, len(registerData{}))
+	default:
+		return polledRange{opType: sType, start: int(sReg) - offset, end: int(fReg) - offset}, true
+	}
+	return polledRange{}, false
+}
+
+// rangeCovers checks that count registers from idx are read by the configured ranges. As
+// with the collector, a range reads from start up to, but not including, finish.
+func rangeCovers(ranges []polledRange, opType, idx, count int) bool {
+	for n := idx; n < idx+count; n++ {
+		found := false
+		for _, pr := range ranges {
+			if pr.opType == opType && n >= pr.start && n < pr.end {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// logConfigIssues logs every issue and returns an error if any of them are errors.
+func logConfigIssues(cfgFn string, issues []configIssue) error {
+	errors := 0
+	for _, ci := range issues {
+		log.Printf("%s: %s", cfgFn, ci)
+		if !ci.Warning {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("%s: %d configuration errors", cfgFn, errors)
+	}
+	return nil
+}
+
+// checkConfiguration validates the file for -check, printing the results. Returns false if
+// the configuration cannot be used.
+func checkConfiguration(cfgFn string, strict bool) bool {
+	_, issues, err := loadConfiguration(cfgFn, strict)
+	if err != nil {
+		fmt.Printf("%s: %v\n", cfgFn, err)
+		return false
+	}
+	errors := 0
+	for _, ci := range issues {
+		fmt.Printf("%s: %s\n", cfgFn, ci)
+		if !ci.Warning {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return false
+	}
+	fmt.Printf("%s: OK\n", cfgFn)
+	return true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateInvalidConfiguration(t *testing.T) {
+	_, issues, err := loadConfiguration("testdata/invalid_configuration.yaml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"line 14: warning: source.fields[1].idx: registers 200-201",
+		"line 16: error: server.devicename: no server device configured",
+		"line 26: error: clients[0].devices[0].ranges[0].finish: range types do not match",
+		"line 35: error: clients[1].devices[0].id: device id 2 is already exposed at line 27",
+		"line 38: error: clients[1].devices[0].ranges[0].finish: register 40300 is beyond",
+		"line 42: error: virtual[0].expression: expression \"{2:30013} + {9:30013\" at 14: missing }",
+		"line 45: warning: virtual[1].expression: device 9 is not polled by any client",
+		"line 47: error: aggregates[0].device: device 2 is polled by a client",
+		"line 48: error: aggregates[0].layout: unknown meter layout \"sdm999\"",
+		"line 50: warning: aggregates[0].sources[0].device: device 3 is not polled by any client",
+		"line 51: error: aggregates[0].sources[0].phases[0]: phase 4 is not 1, 2 or 3",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %d: %v", len(expected), len(issues), issues)
+	}
+	for n, want := range expected {
+		if !strings.HasPrefix(issues[n].String(), want) {
+			t.Errorf("issue %d: got %q, want prefix %q", n, issues[n], want)
+		}
+	}
+}
+
+func TestStrictConfigurationRejectsUnknownKeys(t *testing.T) {
+	_, _, err := loadConfiguration("testdata/invalid_configuration.yaml", true)
+	if err == nil || !strings.Contains(err.Error(), "line 5: field colour not found") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestSampleConfigurationIsValid(t *testing.T) {
+	_, issues, err := loadConfiguration("sample_configuration.yaml", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatalf("expected no issues, got %v", issues)
+	}
+}
+
+func TestExposeAsAllowsSharedIDs(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(fn, []byte(`
+server: {devicename: /dev/ttyUSB0, baudrate: 9600, parity: N}
+clients:
+- devicename: /dev/ttyUSB1
+  baudrate: 9600
+  parity: N
+  devices:
+  - id: 1
+    ranges: [{start: 30001, finish: 30010}]
+- devicename: /dev/ttyUSB2
+  baudrate: 9600
+  parity: N
+  devices:
+  - id: 1
+    expose_as: 5
+    ranges: [{start: 30001, finish: 30010}]
+  - id: 2
+    expose_as: 5
+    ranges: [{start: 30001, finish: 30010}]
+`), 0644)
+	cfg, issues, err := loadConfiguration(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || !strings.HasPrefix(issues[0].String(), "line 18: error: clients[1].devices[1].expose_as: device id 5 is already exposed at line 15") {
+		t.Fatalf("expected only the second device exposed as 5 to be reported, got %v", issues)
+	}
+	if _, found := devicePolledRanges(cfg, 5); !found {
+		t.Error("expected device 5 to be polled")
+	}
+	if got := exposedDeviceID(cfg, "/dev/ttyUSB2", 1); got != 5 {
+		t.Errorf("expected unit 1 on /dev/ttyUSB2 to be exposed as 5, got %d", got)
+	}
+}
+
+func TestServerPortsConfiguration(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(fn, []byte(`
+servers:
+- {devicename: /dev/ttyUSB0, baudrate: 9600, parity: N, units: [1], access: {read_only: true, functions: [3, 6, 0]}}
+- {devicename: /dev/ttyUSB2, baudrate: 9600, parity: N, units: [2, 7]}
+- {tcp: ":5020"}
+- {tcp: ":5020"}
+- {devicename: /dev/ttyUSB3, baudrate: 9600, parity: N, shared: true}
+clients:
+- devicename: /dev/ttyUSB2
+  baudrate: 9600
+  parity: N
+  devices:
+  - id: 2
+    ranges: [{start: 30001, finish: 30010}]
+`), 0644)
+	cfg, issues, err := loadConfiguration(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"line 3: warning: servers[0].access.functions[1]: function 6 writes, but the port is read only",
+		"line 3: error: servers[0].access.functions[2]: 0 is not a valid function code",
+		"line 4: warning: servers[1].units[1]: unit 7 is not polled by any client",
+		"line 6: error: servers[3].tcp: :5020 is already used by the server port at line 5",
+		"line 7: warning: servers[4].shared: the port is on a shared bus but answers every unit held, list the units exposed",
+		"line 9: error: clients[0].devicename: /dev/ttyUSB2 is also used by the server",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %v", len(expected), issues)
+	}
+	for n, want := range expected {
+		if issues[n].String() != want {
+			t.Errorf("issue %d: got %q, want %q", n, issues[n], want)
+		}
+	}
+	if ports := cfg.serverPorts(); len(ports) != 5 || !ports[1].serves(7) || ports[1].serves(1) || !ports[2].serves(1) {
+		t.Errorf("unexpected server ports %+v", ports)
+	}
+}
+
+func TestIdentificationConfiguration(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(fn, []byte(`
+server: {devicename: /dev/ttyUSB0, baudrate: 9600, parity: N}
+clients:
+- devicename: /dev/ttyUSB1
+  baudrate: 9600
+  parity: N
+  devices:
+  - id: 2
+    ranges: [{start: 30001, finish: 30010}]
+    identification:
+      mirror: true
+      extended: {7: "reserved", 128: "site"}
+aggregates:
+- device: 5
+  layout: sdm120
+  sources: [{device: 2}]
+  identification: {mirror: true}
+`), 0644)
+	_, issues, err := loadConfiguration(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"line 12: error: clients[0].devices[0].identification.extended.7: object 7 is not an extended object, which are 128 to 255",
+		"line 17: error: aggregates[0].identification.mirror: an aggregate has no upstream device to mirror",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %v", len(expected), issues)
+	}
+	for n, want := range expected {
+		if issues[n].String() != want {
+			t.Errorf("issue %d: got %q, want %q", n, issues[n], want)
+		}
+	}
+}
+
+func TestDeviceIDConfiguration(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(fn, []byte(`
+server: {devicename: /dev/ttyUSB0, baudrate: 9600, parity: N}
+clients:
+- devicename: /dev/ttyUSB1
+  baudrate: 9600
+  parity: N
+  devices:
+  - {id: 248, ranges: [{start: 30001, finish: 30010}]}
+  - {id: 2, expose_as: 250, ranges: [{start: 30001, finish: 30010}]}
+  - {id: 3, ranges: [{start: 30001, finish: 30010}]}
+virtual:
+- {device: 6, register: 30001, type: float32, value: 1}
+aggregates:
+- {device: 5, layout: sdm120, sources: [{device: 3}]}
+- {device: 5, layout: sdm120, sources: [{device: 3}]}
+- {device: 6, layout: sdm120, sources: [{device: 3}]}
+`), 0644)
+	_, issues, err := loadConfiguration(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"line 8: error: clients[0].devices[0].id: device id 248 is not a unit ID, which are 1 to 247",
+		"line 9: error: clients[0].devices[1].expose_as: device id 250 is not a unit ID, which are 1 to 247",
+		"line 15: error: aggregates[1].device: device 5 is already the aggregate at line 14",
+		"line 16: error: aggregates[2].device: device 6 has virtual registers, an aggregate needs an unused device id",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %v", len(expected), issues)
+	}
+	for n, want := range expected {
+		if issues[n].String() != want {
+			t.Errorf("issue %d: got %q, want %q", n, issues[n], want)
+		}
+	}
+}
+
+func TestRangeOffsetConfiguration(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(fn, []byte(`
+server: {devicename: /dev/ttyUSB0, baudrate: 9600, parity: N}
+clients:
+- devicename: /dev/ttyUSB1
+  baudrate: 9600
+  parity: N
+  devices:
+  - id: 2
+    ranges:
+    - {start: 48193, finish: 48209, offset: 8192}
+    - {start: 48193, finish: 48209}
+    - {start: 48193, finish: 48209, offset: 7900}
+    - {start: 40011, finish: 40021, offset: 20}
+`), 0644)
+	_, issues, err := loadConfiguration(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"line 11: error: clients[0].devices[0].ranges[1].finish: register 48209 is beyond the 256 registers held for each device, use an offset to hold it lower",
+		"line 12: error: clients[0].devices[0].ranges[2].finish: register 48209 is held as 308, beyond the 256 registers held for each device, increase the offset",
+		"line 13: error: clients[0].devices[0].ranges[3].offset: offset 20 is not between 0 and the start register 10",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %v", len(expected), issues)
+	}
+	for n, want := range expected {
+		if issues[n].String() != want {
+			t.Errorf("issue %d: got %q, want %q", n, issues[n], want)
+		}
+	}
+}
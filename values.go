@@ -0,0 +1,93 @@
+package main
+
+/* Value types.
+ * Meters hold values in one or two registers. These are the types that can be used for
+ * simulated and virtual registers, big endian with the high word first. A two register
+ * type with a _swapped suffix has the low word first, as used by Carlo Gavazzi meters.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const swappedSuffix = "_swapped"
+
+// swapWords swaps the registers of a two register value.
+func swapWords(data []byte) []byte {
+	return []byte{data[2], data[3], data[0], data[1]}
+}
+
+// validValueType checks the type is one that can be encoded.
+func validValueType(typ string) bool {
+	switch typ {
+	case "", "float32", "uint16", "int16", "uint32", "int32":
+		return true
+	case "float32" + swappedSuffix, "uint32" + swappedSuffix, "int32" + swappedSuffix:
+		return true
+	}
+	return false
+}
+
+// registerSize returns the number of registers used by a value type.
+func registerSize(typ string) int {
+	switch typ {
+	case "uint16", "int16":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// encodeRegisterValue encodes the value as registers of the given type, rounding it
+// for integer types.
+func encodeRegisterValue(typ string, v float64) ([]byte, error) {
+	if base, ok := strings.CutSuffix(typ, swappedSuffix); ok && validValueType(typ) {
+		out, err := encodeRegisterValue(base, v)
+		if err != nil {
+			return nil, err
+		}
+		return swapWords(out), nil
+	}
+	out := make([]byte, registerSize(typ)*2)
+	switch typ {
+	case "float32", "":
+		binary.BigEndian.PutUint32(out, math.Float32bits(float32(v)))
+	case "uint16":
+		binary.BigEndian.PutUint16(out, uint16(math.Round(v)))
+	case "int16":
+		binary.BigEndian.PutUint16(out, uint16(int16(math.Round(v))))
+	case "uint32":
+		binary.BigEndian.PutUint32(out, uint32(math.Round(v)))
+	case "int32":
+		binary.BigEndian.PutUint32(out, uint32(int32(math.Round(v))))
+	default:
+		return nil, fmt.Errorf("unknown value type %q", typ)
+	}
+	return out, nil
+}
+
+// decodeRegisterValue decodes registers of the given type.
+func decodeRegisterValue(typ string, data []byte) (float64, error) {
+	if len(data) < registerSize(typ)*2 {
+		return 0, fmt.Errorf("%d bytes is too short for %s", len(data), typ)
+	}
+	if base, ok := strings.CutSuffix(typ, swappedSuffix); ok && validValueType(typ) {
+		return decodeRegisterValue(base, swapWords(data))
+	}
+	switch typ {
+	case "float32", "":
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case "uint16":
+		return float64(binary.BigEndian.Uint16(data)), nil
+	case "int16":
+		return float64(int16(binary.BigEndian.Uint16(data))), nil
+	case "uint32":
+		return float64(binary.BigEndian.Uint32(data)), nil
+	case "int32":
+		return float64(int32(binary.BigEndian.Uint32(data))), nil
+	}
+	return 0, fmt.Errorf("unknown value type %q", typ)
+}
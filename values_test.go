@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEncodeRegisterValue(t *testing.T) {
+	tests := []struct {
+		typ  string
+		v    float64
+		want []byte
+	}{
+		{"uint16", 513, []byte{2, 1}},
+		{"int16", -2, []byte{0xff, 0xfe}},
+		{"int32", -2, []byte{0xff, 0xff, 0xff, 0xfe}},
+		{"int32_swapped", 65538, []byte{0, 2, 0, 1}},
+		{"int16", 229.96, []byte{0, 230}},
+		{"", 1, []byte{0x3f, 0x80, 0, 0}},
+	}
+	for _, tc := range tests {
+		got, err := encodeRegisterValue(tc.typ, tc.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(tc.want) {
+			t.Errorf("%s %v: expected % x got % x", tc.typ, tc.v, tc.want, got)
+		}
+	}
+	if _, err := encodeRegisterValue("float16", 1); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+func TestDecodeRegisterValue(t *testing.T) {
+	for typ, want := range map[string]float64{"float32": -1.5, "uint16": 65535, "int16": -1, "uint32": 70000, "int32": -70000, "int32_swapped": -70000, "float32_swapped": 0.5} {
+		raw, err := encodeRegisterValue(typ, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := decodeRegisterValue(typ, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want {
+			t.Errorf("%s: expected %v got %v", typ, want, v)
+		}
+	}
+	if _, err := decodeRegisterValue("int32", []byte{1, 2}); err == nil {
+		t.Error("expected an error for short data")
+	}
+}
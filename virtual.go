@@ -0,0 +1,155 @@
+package main
+
+/* Virtual registers.
+ * A virtual register is returned by the server in place of the cached value. It can be a
+ * constant or an expression combining registers of any devices, so a synthetic meter can
+ * be presented to the master from several physical devices. A device with only virtual
+ * registers need not be polled by any client.
+ */
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+type registerOverride struct {
+	Device     byte
+	Register   int
+	Type       string
+	Value      *float64
+	Expression string
+	expr       exprNode
+}
+
+var (
+	overrideErrors   = make(map[string]bool)
+	overrideErrorsMu sync.Mutex
+)
+
+// compileOverrides parses the expressions. Errors are reported by validation.
+func compileOverrides(overrides []registerOverride) {
+	for n := range overrides {
+		ov := &overrides[n]
+		if ov.Expression != "" {
+			ov.expr, _ = parseExpression(ov.Expression, ov.Type)
+		}
+	}
+}
+
+// virtualDevices returns the devices with virtual registers.
+func virtualDevices(cfg configData) []byte {
+	seen := make(map[byte]bool)
+	var ids []byte
+	for _, ov := range cfg.Virtual {
+		if !seen[ov.Device] {
+			seen[ov.Device] = true
+			ids = append(ids, ov.Device)
+		}
+	}
+	return ids
+}
+
+// virtualDeviceUsed checks whether the virtual section has registers for the device.
+func virtualDeviceUsed(cfg *configData, id byte) bool {
+	for _, ov := range cfg.Virtual {
+		if ov.Device == id {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVirtualDevice(cfg *configData, id byte) bool {
+	if virtualDeviceUsed(cfg, id) {
+		return true
+	}
+	for _, agg := range cfg.Aggregates {
+		if agg.Device == id {
+			return true
+		}
+	}
+	return false
+}
+
+// addVirtualDevices makes sure there are register tables for every device with virtual registers.
+func addVirtualDevices(cfg configData) {
+	for _, id := range virtualDevices(cfg) {
+		if _, mErr := getRegisterAccess(id, 3); mErr == unknownDevice {
+			addStandardDevice(id)
+		}
+	}
+}
+
+// lookupRegister returns the cached value of a register.
+func lookupRegister(ref registerRef) (float64, error) {
+	typ, reg, err := parseRegister(ref.register)
+	if err != nil {
+		return 0, err
+	}
+	regA, mErr := getRegisterAccess(ref.device, registerTable(typ))
+	if mErr != modbusSuccess {
+		return 0, fmt.Errorf("device %d: %v", ref.device, mErr)
+	}
+	data, mErr := regA.Read(int(reg), registerSize(ref.typ))
+	if mErr != modbusSuccess {
+		return 0, fmt.Errorf("device %d register %d: %v", ref.device, ref.register, mErr)
+	}
+	return decodeRegisterValue(ref.typ, data[1:])
+}
+
+// value calculates the virtual register's value.
+func (ov registerOverride) value() (float64, error) {
+	switch {
+	case ov.Value != nil:
+		return *ov.Value, nil
+	case ov.expr != nil:
+		return ov.expr.eval(lookupRegister)
+	}
+	return 0, fmt.Errorf("no value or valid expression")
+}
+
+// logOverrideError logs the first of each error, as it would otherwise be logged on every request.
+func logOverrideError(ov registerOverride, err error) {
+	msg := fmt.Sprintf("Server: virtual register %d on device %d: %v", ov.Register, ov.Device, err)
+	overrideErrorsMu.Lock()
+	defer overrideErrorsMu.Unlock()
+	if !overrideErrors[msg] {
+		overrideErrors[msg] = true
+		log.Print(msg)
+	}
+}
+
+// applyOverrides replaces the values of any virtual registers in the data read from the
+// table (function) of the device. The data starts with the byte count, as returned by Read.
+func applyOverrides(overrides []registerOverride, device, function byte, start int, data []byte) {
+	for _, ov := range overrides {
+		if ov.Device != device {
+			continue
+		}
+		typ, reg, err := parseRegister(ov.Register)
+		if err != nil || registerTable(typ) != function {
+			continue
+		}
+		size := registerSize(ov.Type)
+		first, count := int(reg), (len(data)-1)/2
+		if first+size <= start || first >= start+count {
+			continue
+		}
+		v, err := ov.value()
+		if err != nil {
+			logOverrideError(ov, err)
+			continue
+		}
+		raw, err := encodeRegisterValue(ov.Type, v)
+		if err != nil {
+			logOverrideError(ov, err)
+			continue
+		}
+		for n := 0; n < size; n++ {
+			if idx := first + n - start; idx >= 0 && idx < count {
+				copy(data[1+idx*2:3+idx*2], raw[n*2:n*2+2])
+			}
+		}
+	}
+}
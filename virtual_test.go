@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	devices = make(map[byte]map[byte]*registerAccess)
+	addStandardDevice(2)
+	addStandardDevice(3)
+	for dev, v := range map[byte]float32{2: 1200, 3: 300} {
+		raw := binary.BigEndian.AppendUint32(nil, math.Float32bits(v))
+		regA, _ := getRegisterAccess(dev, 4)
+		regA.Write(12, 2, raw)
+	}
+
+	zero := 0.0
+	cfg := configData{Virtual: []registerOverride{
+		{Device: 10, Register: 30013, Expression: "{2:30013} + {3:30013}"},
+		{Device: 10, Register: 30015, Type: "uint16", Value: &zero},
+		{Device: 10, Register: 40001, Type: "int16", Expression: "-{2:30013:float32}"},
+	}}
+	compileOverrides(cfg.Virtual)
+	addVirtualDevices(cfg)
+
+	regA, mErr := getRegisterAccess(10, 4)
+	if mErr != modbusSuccess {
+		t.Fatal(mErr)
+	}
+	regA.Write(14, 1, []byte{0xff, 0xff})
+	data, _ := regA.Read(12, 3)
+	applyOverrides(cfg.Virtual, 10, 4, 12, data)
+	if v := math.Float32frombits(binary.BigEndian.Uint32(data[1:])); v != 1500 {
+		t.Errorf("expected sum of 1500, got %v", v)
+	}
+	if v := binary.BigEndian.Uint16(data[5:]); v != 0 {
+		t.Errorf("expected constant 0, got %d", v)
+	}
+
+	// A read of just the second register of the sum gets the low word.
+	data, _ = regA.Read(13, 1)
+	applyOverrides(cfg.Virtual, 10, 4, 13, data)
+	if v := binary.BigEndian.Uint16(data[1:]); v != uint16(math.Float32bits(1500)) {
+		t.Errorf("expected low word of the sum, got %04x", v)
+	}
+
+	regA, _ = getRegisterAccess(10, 3)
+	data, _ = regA.Read(0, 1)
+	applyOverrides(cfg.Virtual, 10, 3, 0, data)
+	if v := int16(binary.BigEndian.Uint16(data[1:])); v != -1200 {
+		t.Errorf("expected holding register -1200, got %d", v)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+/* A small status dashboard, intended to be usable from a phone when on site.
+ * Everything is rendered server side and the page refreshes itself, so no
+ * javascript or external assets are required.
+ */
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/zathras777/modbusdev"
+)
+
+type dashAction struct {
+	Description string
+	Errors      int
+	LastPoll    string
+}
+
+type dashDevice struct {
+	ID       byte
+	Upstream byte
+	Actions  []dashAction
+}
+
+type dashBus struct {
+	Name    string
+	Devices []dashDevice
+}
+
+type dashCell struct {
+	Hex   string
+	Title string
+}
+
+type dashRow struct {
+	Start int
+	Cells []dashCell
+}
+
+type dashTable struct {
+	Device byte
+	Name   string
+	Rows   []dashRow
+}
+
+type dashField struct {
+	Name  string
+	Idx   int
+	Value string
+	Units string
+}
+
+type dashboardData struct {
+	Name          string
+	Now           string
+	Servers       []serverData
+	MQTTHost      string
+	MQTTPort      uint
+	MQTTConnected bool
+	Buses         []dashBus
+	Fields        []dashField
+	Tables        []dashTable
+	Requests      []requestLogEntry
+}
+
+var tableNames = map[byte]string{3: "Holding", 4: "Input"}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"hex2": func(b byte) string { return fmt.Sprintf("%02X", b) },
+	"time": func(t time.Time) string { return t.Format("15:04:05.000") },
+}).Parse(dashboardHTML))
+
+func sinceString(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(t).Round(time.Second))
+}
+
+func buildDashboardData() dashboardData {
+	cfg := currentConfig()
+	data := dashboardData{
+		Name:     cfg.Name,
+		Now:      time.Now().Format(time.RFC1123),
+		Servers:  cfg.serverPorts(),
+		MQTTHost: cfg.MQTT.Host,
+		MQTTPort: cfg.MQTT.Port,
+		Requests: recentServerRequests(),
+	}
+	if client := currentMQTTClient(); client != nil {
+		data.MQTTConnected = client.IsConnected()
+	}
+
+	for _, bus := range currentBusses() {
+		db := dashBus{Name: bus.name}
+		for _, dev := range bus.devices {
+			dd := dashDevice{ID: dev.exposed, Upstream: dev.id}
+			for _, act := range dev.actions {
+				dd.Actions = append(dd.Actions, dashAction{Description: act.String(),
+					Errors: act.errorCount(), LastPoll: sinceString(act.lastSuccess())})
+			}
+			db.Devices = append(db.Devices, dd)
+		}
+		data.Buses = append(data.Buses, db)
+	}
+
+	if regA, err := getRegisterAccess(cfg.Source.DeviceID, 4); err == modbusSuccess {
+		var v modbusdev.Value
+		for _, fld := range cfg.Source.Fields {
+			df := dashField{Name: fld.Name, Idx: fld.Idx, Units: fld.Units, Value: "-"}
+			if raw, err := regA.Read(fld.Idx, 2); err == modbusSuccess {
+				v.FormatBytes("ieee32", raw[1:])
+				df.Value = fmt.Sprintf("%.02f", v.Ieee32)
+			}
+			data.Fields = append(data.Fields, df)
+		}
+	}
+
+	for _, id := range deviceIDs() {
+		for _, fn := range []byte{3, 4} {
+			regA, err := getRegisterAccess(id, fn)
+			if err != modbusSuccess {
+				continue
+			}
+			data.Tables = append(data.Tables, buildDashTable(id, tableNames[fn], regA.Values()))
+		}
+	}
+	return data
+}
+
+func buildDashTable(id byte, name string, vals registerData) dashTable {
+	tbl := dashTable{Device: id, Name: name}
+	for start := 0; start < len(vals); start += 16 {
+		row := dashRow{Start: start}
+		for n := start; n < start+16; n++ {
+			title := fmt.Sprintf("%d: uint16 %d, int16 %d", n, vals[n], int16(vals[n]))
+			if n+1 < len(vals) {
+				var v modbusdev.Value
+				v.FormatBytes("ieee32", []byte{byte(vals[n] >> 8), byte(vals[n]), byte(vals[n+1] >> 8), byte(vals[n+1])})
+				title += fmt.Sprintf(", float32 %g", v.Ieee32)
+			}
+			row.Cells = append(row.Cells, dashCell{Hex: fmt.Sprintf("%04X", vals[n]), Title: title})
+		}
+		tbl.Rows = append(tbl.Rows, row)
+	}
+	return tbl
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, buildDashboardData()); err != nil {
+		log.Printf("HTTP: dashboard: %v", err)
+	}
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="5">
+<title>{{.Name}} - Meter Proxy</title>
+<style>
+body { font-family: sans-serif; margin: 0.5em; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+.regs td { font-family: monospace; }
+.scroll { overflow-x: auto; }
+.ok { color: green; } .bad { color: red; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>{{.Now}}</p>
+
+<h2>Status</h2>
+<table>
+{{range .Servers}}<tr><th>Server</th><td>{{if .TCP}}TCP {{.TCP}}{{else}}{{.Devicename}} @ {{.Baudrate}} {{.Parity}}{{end}}
+{{if .Units}}units {{range $n, $id := .Units}}{{if $n}}, {{end}}{{$id}}{{end}}{{end}}</td></tr>
+{{end}}
+<tr><th>MQTT</th><td>{{.MQTTHost}}:{{.MQTTPort}}
+{{if .MQTTConnected}}<span class="ok">connected</span>{{else}}<span class="bad">disconnected</span>{{end}}</td></tr>
+</table>
+
+<h2>Collectors</h2>
+<div class="scroll"><table>
+<tr><th>Bus</th><th>Device</th><th>Range</th><th>Errors</th><th>Last Poll</th></tr>
+{{range $bus := .Buses}}{{range $dev := .Devices}}{{range .Actions}}
+<tr><td>{{$bus.Name}}</td><td>{{$dev.ID}}{{if ne $dev.ID $dev.Upstream}} (unit {{$dev.Upstream}}){{end}}</td><td>{{.Description}}</td>
+<td{{if .Errors}} class="bad"{{end}}>{{.Errors}}</td><td>{{.LastPoll}}</td></tr>
+{{end}}{{end}}{{end}}
+</table></div>
+
+<h2>Fields</h2>
+<table>
+<tr><th>Name</th><th>Index</th><th>Value</th></tr>
+{{range .Fields}}<tr><td>{{.Name}}</td><td>{{.Idx}}</td><td>{{.Value}} {{.Units}}</td></tr>
+{{end}}
+</table>
+
+<h2>Recent Server Requests</h2>
+<div class="scroll"><table>
+<tr><th>Time</th><th>Port</th><th>Unit</th><th>Function</th><th>Data</th><th>Result</th></tr>
+{{range .Requests}}<tr><td>{{time .When}}</td><td>{{.Port}}</td><td>{{.Address}}</td><td>{{hex2 .Function}}</td>
+<td class="regs">{{.Data}}</td><td>{{.Exception.Error}}</td></tr>
+{{end}}
+</table></div>
+
+<h2>Registers</h2>
+{{range .Tables}}
+<h3>Device {{.Device}}: {{.Name}}</h3>
+<div class="scroll"><table class="regs">
+{{range .Rows}}<tr><th>{{.Start}}</th>{{range .Cells}}<td title="{{.Title}}">{{.Hex}}</td>{{end}}</tr>
+{{end}}
+</table></div>
+{{end}}
+</body>
+</html>
+`
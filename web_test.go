@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tbrandon/mbserver"
+)
+
+func TestDashboard(t *testing.T) {
+	regA := setupTestEnvironment(t)
+	writeFloatToRegister(t, regA, 230.5)
+	if err := regA.Write(17, 1, []byte{0xbe, 0xef}); err != modbusSuccess {
+		t.Fatalf("register write failed: %v", err)
+	}
+
+	act := &deviceAction{opType: 3, startRegister: 0, finishRegister: 20, numRegs: 20, errors: 2}
+	bussesMu.Lock()
+	deviceBusses = []deviceBus{{name: "/dev/ttyUSB0", devices: []device{{id: 7, exposed: 1, actions: []*deviceAction{act}}}}}
+	bussesMu.Unlock()
+	recentMu.Lock()
+	recentRequests = nil
+	recentMu.Unlock()
+	t.Cleanup(func() {
+		bussesMu.Lock()
+		deviceBusses = nil
+		bussesMu.Unlock()
+		recentMu.Lock()
+		recentRequests = nil
+		recentMu.Unlock()
+	})
+	logRecentRequest("rs485", &mbserver.RTUFrame{Address: 1, Function: 4, Data: []byte{0, 0, 0, 2}}, modbusSuccess)
+	logRecentRequest("rs485", &mbserver.RTUFrame{Address: 1, Function: 4, Data: []byte{1, 0, 0, 2}}, illegalAddress)
+
+	srv := httptest.NewServer(http.HandlerFunc(dashboardHandler))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	page := string(body)
+	for _, want := range []string{
+		"<h1>TestDevice</h1>",
+		// The collector, with its bus, device and range.
+		"<td>/dev/ttyUSB0</td><td>1 (unit 7)</td><td>ReadInputRegisters from 0 to 20</td>",
+		`<td class="bad">2</td><td>never</td>`,
+		// The recorded field.
+		"<td>Power</td><td>0</td><td>230.50 W</td>",
+		// The register tables.
+		"<h3>Device 1: Holding</h3>",
+		"<h3>Device 1: Input</h3>",
+		`<td title="17: uint16 48879, int16 -16657`,
+		// The recent requests.
+		"<td>rs485</td><td>1</td><td>04</td>",
+		`<td class="regs">01000002</td><td>` + illegalAddress.Error() + "</td>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected the dashboard to contain %q", want)
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected other paths not to be found, got %d", resp.StatusCode)
+	}
+}